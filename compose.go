@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// useKey is the key in a scraper's fields which lists the field sets to use.
+const useKey = "$use"
+
+// readConfigTree reads a config in any of the supported formats as a JSON
+// object.
+func readConfigTree(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := configFormat(path)
+	data, err = configJSON(format, data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s in %s: %s", strings.ToUpper(format), path, err)
+	}
+	var tree = map[string]interface{}{}
+	err = json.Unmarshal(data, &tree)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s in %s: %s", strings.ToUpper(format), path, err)
+	}
+	return tree, nil
+}
+
+// includeConfigs merges the configs listed in include into the config at
+// path. Included configs are read relative to the config which includes
+// them, as are the paths of their outputs and transforms, and may include
+// others in turn. Arrays at the top level, such as
+// scrapers, are appended in order, and the including config's own values
+// take precedence over anything else.
+func includeConfigs(path string, data []byte) ([]byte, []ConfigProblem, error) {
+	var raw interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, ok := raw.(map[string]interface{})
+	if !ok {
+		return data, nil, nil
+	}
+
+	var problems = configProblems{}
+	tree = includeTree(&problems, path, tree, []string{filepath.Clean(path)})
+	if len(problems) > 0 {
+		return nil, problems, nil
+	}
+
+	data, err = json.Marshal(tree)
+	return data, nil, err
+}
+
+func includeTree(p *configProblems, path string, tree map[string]interface{}, stack []string) map[string]interface{} {
+	var includes []interface{}
+	switch v := tree["include"].(type) {
+	case nil:
+		return tree
+	case string:
+		includes = []interface{}{v}
+	case []interface{}:
+		includes = v
+	default:
+		p.add("include", "should be a path or an array of paths")
+		return tree
+	}
+
+	var merged = map[string]interface{}{}
+	for i, v := range includes {
+		problemPath := fmt.Sprintf("include[%d]", i)
+		if len(stack) > 1 {
+			problemPath = fmt.Sprintf("%s in %s", problemPath, path)
+		}
+		s, ok := v.(string)
+		if !ok {
+			p.add(problemPath, "should be a path")
+			continue
+		}
+		includePath := s
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(path), includePath)
+		}
+		includePath = filepath.Clean(includePath)
+		if containsString(stack, includePath) {
+			p.add(problemPath, "%s includes itself", includePath)
+			continue
+		}
+
+		included, err := readConfigTree(includePath)
+		if err != nil {
+			p.add(problemPath, "%s", err)
+			continue
+		}
+		rebasePaths(included, filepath.Dir(includePath))
+		included = includeTree(p, includePath, included, append(stack, includePath))
+		// Its includes have been merged into it, and only the including
+		// config's own include is kept
+		delete(included, "include")
+		merged = mergeIncluded(merged, included)
+	}
+	return mergeIncluded(merged, tree)
+}
+
+// rebasePaths makes the relative paths of the outputs, transforms and field
+// transforms of an included config relative to the directory of the config,
+// as its includes are.
+func rebasePaths(tree map[string]interface{}, dir string) {
+	if sets, ok := tree["fieldSets"].(map[string]interface{}); ok {
+		for _, set := range sets {
+			if fields, ok := set.(map[string]interface{}); ok {
+				rebaseFieldPaths(fields, dir)
+			}
+		}
+	}
+
+	scrapers, _ := tree["scrapers"].([]interface{})
+	for _, v := range scrapers {
+		sc, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch output := sc["output"].(type) {
+		case string:
+			sc["output"] = rebasePath(output, dir)
+		case map[string]interface{}:
+			if path, ok := output["path"].(string); ok {
+				output["path"] = rebasePath(path, dir)
+			}
+		}
+		transforms, _ := sc["transforms"].([]interface{})
+		for i, t := range transforms {
+			switch transform := t.(type) {
+			case string:
+				transforms[i] = rebasePath(transform, dir)
+			case map[string]interface{}:
+				if path, ok := transform["path"].(string); ok {
+					transform["path"] = rebasePath(path, dir)
+				}
+			}
+		}
+		if fields, ok := sc["fields"].(map[string]interface{}); ok {
+			rebaseFieldPaths(fields, dir)
+		}
+	}
+}
+
+func rebaseFieldPaths(fields map[string]interface{}, dir string) {
+	for _, v := range fields {
+		f, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if path, ok := f["transform"].(string); ok {
+			f["transform"] = rebasePath(path, dir)
+		}
+		if nested, ok := f["fields"].(map[string]interface{}); ok {
+			rebaseFieldPaths(nested, dir)
+		}
+	}
+}
+
+func rebasePath(path string, dir string) string {
+	if path == "" || path == outputStdout || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// mergeIncluded merges the top level of a config into base, appending arrays
+// and merging objects.
+func mergeIncluded(base map[string]interface{}, config map[string]interface{}) map[string]interface{} {
+	for k, v := range config {
+		baseArray, ok := base[k].([]interface{})
+		array, isArray := v.([]interface{})
+		if ok && isArray {
+			base[k] = append(append([]interface{}{}, baseArray...), array...)
+			continue
+		}
+		base[k] = mergeValue(base[k], v)
+	}
+	return base
+}
+
+// mergeValue merges over into base. Objects are merged key by key, and any
+// other value in over replaces the one in base.
+func mergeValue(base interface{}, over interface{}) interface{} {
+	baseObject, ok := base.(map[string]interface{})
+	overObject, isObject := over.(map[string]interface{})
+	if !ok || !isObject {
+		return over
+	}
+	var merged = map[string]interface{}{}
+	for k, v := range baseObject {
+		merged[k] = v
+	}
+	for k, v := range overObject {
+		merged[k] = mergeValue(merged[k], v)
+	}
+	return merged
+}
+
+// composeConfig resolves the field sets used by scrapers, and then the
+// scrapers they extend.
+func composeConfig(data []byte) ([]byte, []ConfigProblem, error) {
+	var raw interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, ok := raw.(map[string]interface{})
+	if !ok {
+		return data, nil, nil
+	}
+
+	var problems = configProblems{}
+	c := &composer{
+		p:        &problems,
+		sets:     map[string]interface{}{},
+		resolved: map[string]map[string]interface{}{},
+	}
+	if sets, ok := tree["fieldSets"].(map[string]interface{}); ok {
+		c.sets = sets
+		for _, name := range sortedKeys(sets) {
+			if set := c.fieldSet("fieldSets", name, nil); set != nil {
+				sets[name] = set
+			}
+		}
+	}
+
+	if scrapers, ok := tree["scrapers"].([]interface{}); ok {
+		for i, v := range scrapers {
+			sc, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if fields, ok := sc["fields"].(map[string]interface{}); ok {
+				sc["fields"] = c.fields(fmt.Sprintf("scrapers[%d].fields", i), fields, nil)
+			}
+		}
+		c.extendScrapers(scrapers)
+	}
+	if len(problems) > 0 {
+		return nil, problems, nil
+	}
+
+	data, err = json.Marshal(tree)
+	return data, nil, err
+}
+
+type composer struct {
+	p        *configProblems
+	sets     map[string]interface{}
+	resolved map[string]map[string]interface{}
+}
+
+// fieldSet returns a field set with the sets it uses resolved. stack holds
+// the sets being resolved, so that sets which use themselves are reported.
+func (c *composer) fieldSet(path string, name string, stack []string) map[string]interface{} {
+	if set, ok := c.resolved[name]; ok {
+		return set
+	}
+	if containsString(stack, name) {
+		c.p.add(joinPath("fieldSets", name), "uses itself via %s", strings.Join(stack, ", "))
+		return nil
+	}
+	v, ok := c.sets[name]
+	if !ok {
+		c.p.add(path, "no field set is named \"%s\"", name)
+		return nil
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		c.p.add(joinPath("fieldSets", name), "should be an object")
+		return nil
+	}
+	set := c.fields(joinPath("fieldSets", name), fields, append(stack, name))
+	c.resolved[name] = set
+	return set
+}
+
+// fields resolves $use in fields and in any nested fields. The fields of the
+// sets are added in order, and fields of the same name replace them.
+func (c *composer) fields(path string, fields map[string]interface{}, stack []string) map[string]interface{} {
+	var resolved = map[string]interface{}{}
+
+	if use, ok := fields[useKey]; ok {
+		var names []interface{}
+		switch v := use.(type) {
+		case string:
+			names = []interface{}{v}
+		case []interface{}:
+			names = v
+		default:
+			c.p.add(joinPath(path, useKey), "should be a field set or an array of field sets")
+		}
+		for _, v := range names {
+			name, ok := v.(string)
+			if !ok {
+				c.p.add(joinPath(path, useKey), "should be a field set or an array of field sets")
+				continue
+			}
+			for k, field := range c.fieldSet(joinPath(path, useKey), name, stack) {
+				resolved[k] = field
+			}
+		}
+	}
+
+	for k, field := range fields {
+		if k == useKey {
+			continue
+		}
+		if object, ok := field.(map[string]interface{}); ok {
+			if nested, ok := object["fields"].(map[string]interface{}); ok {
+				copied := map[string]interface{}{}
+				for key, v := range object {
+					copied[key] = v
+				}
+				copied["fields"] = c.fields(joinPath(joinPath(path, k), "fields"), nested, stack)
+				field = copied
+			}
+		}
+		resolved[k] = field
+	}
+	return resolved
+}
+
+// extendScrapers replaces each scraper which extends another with the other
+// scraper merged with its own config.
+func (c *composer) extendScrapers(scrapers []interface{}) {
+	var byName = map[string]int{}
+	for i, v := range scrapers {
+		if sc, ok := v.(map[string]interface{}); ok {
+			if name, ok := sc["name"].(string); ok {
+				if _, exists := byName[name]; !exists {
+					byName[name] = i
+				}
+			}
+		}
+	}
+
+	// results holds whether each scraper was extended, so that each problem is
+	// only reported once
+	var results = map[int]bool{}
+	var extend func(i int, stack []int) bool
+	extend = func(i int, stack []int) bool {
+		if ok, visited := results[i]; visited {
+			return ok
+		}
+		ok := c.extendScraper(scrapers, byName, i, stack, extend)
+		results[i] = ok
+		return ok
+	}
+
+	for i := range scrapers {
+		extend(i, nil)
+	}
+}
+
+func (c *composer) extendScraper(scrapers []interface{}, byName map[string]int, i int, stack []int, extend func(int, []int) bool) bool {
+	sc, ok := scrapers[i].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	v, ok := sc["extends"]
+	if !ok {
+		return true
+	}
+	path := fmt.Sprintf("scrapers[%d].extends", i)
+	name, ok := v.(string)
+	if !ok {
+		c.p.add(path, "should be the name of a scraper")
+		return false
+	}
+	parent, ok := byName[name]
+	if !ok {
+		c.p.add(path, "no scraper is named \"%s\"", name)
+		return false
+	}
+	stack = append(stack, i)
+	for _, j := range stack {
+		if j == parent {
+			c.p.add(path, "scraper \"%s\" extends itself", name)
+			return false
+		}
+	}
+	if !extend(parent, stack) {
+		return false
+	}
+
+	scrapers[i] = mergeValue(scrapers[parent], sc)
+	return true
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFiles(files map[string]string) string {
+	dir, err := ioutil.TempDir("", "rugburn")
+	if err != nil {
+		panic(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			panic(err)
+		}
+		err = ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return dir
+}
+
+func TestIncludeConfigs(t *testing.T) {
+	dir := writeConfigFiles(map[string]string{
+		"rug.json": `{
+			"include": ["shared/scrapers.yaml"],
+			"name": "Test",
+			"options": {"spiders": {"concurrency": 2}, "store": {"strategy": "memory"}},
+			"spider": {"urls": ["http://foo.com"]},
+			"scrapers": [{"name": "Own", "output": "own.jsonl", "fields": {"title": "//title"}}]
+		}`,
+		"shared/scrapers.yaml": `
+include: [options.toml]
+scrapers:
+  - name: Shared
+    output: shared.jsonl
+    transforms: [upper.lua]
+    fields:
+      heading: //h1
+      title:
+        xpath: //title
+        transform: upper.lua
+`,
+		"shared/upper.lua": `function transform (value) return value end`,
+		"shared/options.toml": `
+[options.spiders]
+concurrency = 5
+max = 10
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	rugFile, err := loadRugFile(filepath.Join(dir, "rug.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"shared/scrapers.yaml"}, rugFile.Include)
+	assert.Equal(t, 2, rugFile.Options.SpiderOptions.Concurrency)
+	assert.Equal(t, 10, rugFile.Options.SpiderOptions.MaxResults)
+	assert.Equal(t, 2, len(rugFile.Scrapers))
+	assert.Equal(t, "Shared", rugFile.Scrapers[0].Name)
+	assert.Equal(t, "Own", rugFile.Scrapers[1].Name)
+
+	// Paths in an included config are relative to it
+	assert.Equal(t, filepath.Join(dir, "shared/shared.jsonl"), rugFile.Scrapers[0].Output.Path)
+	assert.Equal(t, filepath.Join(dir, "shared/upper.lua"), rugFile.Scrapers[0].Transforms[0].Path)
+	title := rugFile.Scrapers[0].Fields["title"].(map[string]interface{})
+	assert.Equal(t, filepath.Join(dir, "shared/upper.lua"), title["transform"])
+	assert.Equal(t, "own.jsonl", rugFile.Scrapers[1].Output.Path)
+}
+
+func TestIncludeProblems(t *testing.T) {
+	dir := writeConfigFiles(map[string]string{
+		"rug.json": `{"include": ["missing.json", "a.json", 1]}`,
+		"a.json":   `{"include": "b.json"}`,
+		"b.json":   `{"include": "a.json"}`,
+	})
+	defer os.RemoveAll(dir)
+
+	_, err := loadRugFile(filepath.Join(dir, "rug.json"))
+	verr, ok := err.(*ValidationError)
+	if !assert.True(t, ok, "%s", err) {
+		return
+	}
+	assert.Len(t, verr.Problems, 3)
+	assert.Equal(t, "include[0]", verr.Problems[0].Path)
+	assert.Equal(t, "include[0] in "+filepath.Join(dir, "b.json"), verr.Problems[1].Path)
+	assert.Equal(t, filepath.Join(dir, "a.json")+" includes itself", verr.Problems[1].Message)
+	assert.Equal(t, ConfigProblem{"include[2]", "should be a path"}, verr.Problems[2])
+}
+
+func TestFieldSetsAndExtends(t *testing.T) {
+	data, problems, err := composeConfig([]byte(`{
+		"fieldSets": {
+			"page": {"title": "//title", "url": "//link/@href"},
+			"article": {"$use": "page", "body": "//article"}
+		},
+		"scrapers": [{
+			"name": "Base",
+			"output": "base.jsonl",
+			"context": "//main",
+			"fields": {"$use": ["article"], "title": "//h1"},
+			"key": ["url"]
+		}, {
+			"name": "Child",
+			"extends": "Base",
+			"output": "child.jsonl",
+			"fields": {
+				"author": "//address",
+				"comments": {"context": "//li", "fields": {"$use": "page"}}
+			}
+		}, {
+			"name": "Grandchild",
+			"extends": "Child",
+			"output": "grandchild.jsonl"
+		}]
+	}`))
+	assert.NoError(t, err)
+	assert.Len(t, problems, 0)
+
+	rugFile, problems, err := validateRugFile(data)
+	assert.NoError(t, err)
+	for _, p := range problems {
+		// Only the missing options and spider should be reported
+		assert.NotContains(t, p.Path, "scrapers")
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"title": "//h1",
+		"url":   "//link/@href",
+		"body":  "//article",
+	}, rugFile.Scrapers[0].Fields)
+
+	child := rugFile.Scrapers[1]
+	assert.Equal(t, "Child", child.Name)
+	assert.Equal(t, "child.jsonl", child.Output.Path)
+	assert.Equal(t, "//main", child.Context)
+	assert.Equal(t, []string{"url"}, child.Key)
+	assert.Equal(t, "//address", child.Fields["author"])
+	assert.Equal(t, "//h1", child.Fields["title"])
+	assert.Equal(t, map[string]interface{}{
+		"context": "//li",
+		"fields":  map[string]interface{}{"title": "//title", "url": "//link/@href"},
+	}, child.Fields["comments"])
+
+	assert.Equal(t, child.Fields, rugFile.Scrapers[2].Fields)
+	assert.Equal(t, "grandchild.jsonl", rugFile.Scrapers[2].Output.Path)
+}
+
+func TestExtendsSharedOutput(t *testing.T) {
+	dir := writeConfigFiles(map[string]string{
+		"rug.json": `{
+			"name": "Test",
+			"options": {"spiders": {"concurrency": 1}, "store": {"strategy": "memory"}},
+			"spider": {"urls": ["http://foo.com"]},
+			"scrapers": [
+				{"name": "Articles", "output": "articles.jsonl", "fields": {"title": "//title"}},
+				{"name": "Drafts", "extends": "Articles", "test": "//div[@class=\"draft\"]"}
+			]
+		}`,
+	})
+	defer os.RemoveAll(dir)
+
+	// A scraper which extends another needs its own output
+	_, err := loadRugFile(filepath.Join(dir, "rug.json"))
+	verr, ok := err.(*ValidationError)
+	if !assert.True(t, ok, "%s", err) {
+		return
+	}
+	assert.Equal(t, []ConfigProblem{{"scrapers[1].output", "scraper \"Articles\" writes to the same output"}}, verr.Problems)
+}
+
+func TestComposeProblems(t *testing.T) {
+	_, problems, err := composeConfig([]byte(`{
+		"fieldSets": {
+			"a": {"$use": "b"},
+			"b": {"$use": "a"}
+		},
+		"scrapers": [
+			{"name": "One", "fields": {"$use": "missing"}},
+			{"name": "Two", "extends": "Three"},
+			{"name": "Three", "extends": "Two"},
+			{"name": "Four", "extends": "Five"}
+		]
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []ConfigProblem{
+		{"fieldSets.a", "uses itself via a, b"},
+		{"scrapers[0].fields.$use", "no field set is named \"missing\""},
+		{"scrapers[2].extends", "scraper \"Two\" extends itself"},
+		{"scrapers[3].extends", "no scraper is named \"Five\""},
+	}, problems)
+}
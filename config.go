@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const formatJSON = "json"
+const formatYAML = "yaml"
+const formatTOML = "toml"
+
+// rugFileNames are the configs looked for in the current directory when
+// --config isn't given, in order.
+var rugFileNames = []string{"rug.json", "rug.yaml", "rug.yml", "rug.toml"}
+
+// findRugFile returns the path of the first config which exists in the
+// current directory, or rug.json if there isn't one.
+func findRugFile() string {
+	for _, name := range rugFileNames {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return rugFileNames[0]
+}
+
+// configFormat returns the format of a config from its extension. Anything
+// which isn't YAML or TOML is read as JSON.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	}
+	return formatJSON
+}
+
+// loadRugFile reads a config in any of the supported formats, merges in the
+// configs it includes, interpolates environment variables into it, resolves
+// field sets and scrapers which extend others, and then validates it.
+// Variables which aren't set in the environment are read from a .env next to
+// the config.
+func loadRugFile(path string) (*RugFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't find rugburn config in %s", path)
+	}
+
+	format := configFormat(path)
+	data, err = configJSON(format, data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s in %s: %s", strings.ToUpper(format), path, err)
+	}
+
+	env, err := readEnvFile(filepath.Join(filepath.Dir(path), envFile))
+	if err != nil {
+		return nil, err
+	}
+
+	// Each step rewrites the config as JSON, in order
+	var steps = []func([]byte) ([]byte, []ConfigProblem, error){
+		func(data []byte) ([]byte, []ConfigProblem, error) {
+			return includeConfigs(path, data)
+		},
+		func(data []byte) ([]byte, []ConfigProblem, error) {
+			return interpolateConfig(data, env)
+		},
+		composeConfig,
+	}
+	for _, step := range steps {
+		var problems []ConfigProblem
+		data, problems, err = step(data)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s in %s: %s", strings.ToUpper(format), path, err)
+		}
+		if len(problems) > 0 {
+			return nil, &ValidationError{path, problems}
+		}
+	}
+
+	rugFile, problems, err := validateRugFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s in %s: %s", strings.ToUpper(format), path, err)
+	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{path, problems}
+	}
+	return rugFile, nil
+}
+
+// configJSON converts a YAML or TOML config into JSON, so that every format
+// is decoded and validated the same way.
+func configJSON(format string, data []byte) ([]byte, error) {
+	var v interface{}
+	switch format {
+	case formatYAML:
+		err := yaml.Unmarshal(data, &v)
+		if err != nil {
+			return nil, err
+		}
+		v, err = yamlValue(v)
+		if err != nil {
+			return nil, err
+		}
+	case formatTOML:
+		var m = make(map[string]interface{})
+		_, err := toml.Decode(string(data), &m)
+		if err != nil {
+			return nil, err
+		}
+		v = m
+	default:
+		return data, nil
+	}
+	return json.Marshal(v)
+}
+
+// yamlValue converts the maps decoded from YAML, which may have keys of any
+// type, into maps with string keys.
+func yamlValue(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		var m = make(map[string]interface{})
+		for k, item := range value {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("Key %v should be a string", k)
+			}
+			converted, err := yamlValue(item)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = converted
+		}
+		return m, nil
+	case []interface{}:
+		var items = []interface{}{}
+		for _, item := range value {
+			converted, err := yamlValue(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, converted)
+		}
+		return items, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigFormats(t *testing.T) {
+	err := os.Mkdir("transforms", 0700)
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll("transforms")
+	err = ioutil.WriteFile("transforms/UppercaseTitle.lua", []byte(`function transform(state) return state end`), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	var rugFiles = []*RugFile{}
+	for _, format := range []string{formatJSON, formatYAML, formatTOML} {
+		rugFile, err := loadRugFile("bindata/rug." + format)
+		if !assert.NoError(t, err, format) {
+			continue
+		}
+		rugFiles = append(rugFiles, rugFile)
+	}
+
+	assert.Len(t, rugFiles, 3)
+	for _, rugFile := range rugFiles[1:] {
+		assert.Equal(t, rugFiles[0], rugFile)
+	}
+	assert.Equal(t, `//a[@class="storylink"]`, rugFiles[0].Scrapers[0].Context)
+	assert.Equal(t, "links.jsonl", rugFiles[0].Scrapers[0].Output.Path)
+}
+
+func TestConfigProblemsInYAML(t *testing.T) {
+	err := ioutil.WriteFile("test_rug.yaml", []byte("name: Test\noptions:\n  spiders:\n    concurency: 3\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove("test_rug.yaml")
+
+	_, err = loadRugFile("test_rug.yaml")
+	verr, ok := err.(*ValidationError)
+	if assert.True(t, ok) {
+		assert.Equal(t, "options.spiders.concurency", verr.Problems[0].Path)
+	}
+
+	err = ioutil.WriteFile("test_rug.toml", []byte("name = \n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove("test_rug.toml")
+
+	_, err = loadRugFile("test_rug.toml")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid TOML in test_rug.toml")
+}
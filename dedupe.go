@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const dedupeFirst = "first"
+const dedupeLast = "last"
+const dedupeMerge = "merge"
+
+// deduper drops records whose key has already been seen by a scraper, in this
+// run or a previous one.
+//
+// With the first strategy the first record for a key is written straight
+// away and any later ones are dropped. With the last strategy later records
+// replace earlier ones, and with merge their non-empty fields are merged into
+// the earlier record. For both, records are held in the store until the
+// scraper has finished, and one record is then written for each key which
+// changed during the run. A key which changes in a later run is written
+// again, so both require an output which updates records with the same key
+// in place.
+type deduper struct {
+	db         *leveldb.DB
+	scraper    string
+	key        []string
+	strategy   string
+	duplicates int
+	// batch holds the records kept by the first strategy until the pages
+	// they came from are marked as scraped, so that a page which is scraped
+	// again after a crash doesn't find its record already seen. unstored
+	// holds their keys until the batch is written.
+	batch    *leveldb.Batch
+	unstored map[string]bool
+	// flushed is how many records held back during the run Flush wrote
+	flushed int
+}
+
+func newDeduper(db *leveldb.DB, config *ConfigScraper, batch *leveldb.Batch) (*deduper, error) {
+	if len(config.Key) == 0 {
+		return nil, nil
+	}
+
+	var strategy = config.Dedupe
+	switch strategy {
+	case "":
+		strategy = dedupeFirst
+	case dedupeFirst, dedupeLast, dedupeMerge:
+	default:
+		return nil, fmt.Errorf("Unknown dedupe strategy \"%s\"", config.Dedupe)
+	}
+	if strategy != dedupeFirst && !upsertsKey(config.Output, config.Key) {
+		return nil, fmt.Errorf("Dedupe strategy \"%s\" of scraper %s requires a sqlite output with the same key", strategy, config.Name)
+	}
+
+	return &deduper{
+		db:       db,
+		scraper:  config.Name,
+		key:      config.Key,
+		strategy: strategy,
+		batch:    batch,
+		unstored: map[string]bool{},
+	}, nil
+}
+
+// upsertsKey reports whether an output updates the records with a key in
+// place, rather than appending them again.
+func upsertsKey(output *ConfigOutput, key []string) bool {
+	if output == nil || output.Type != outputSQLite || len(output.Key) != len(key) {
+		return false
+	}
+	var hasKey = map[string]bool{}
+	for _, k := range output.Key {
+		hasKey[k] = true
+	}
+	for _, k := range key {
+		if !hasKey[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// recordKey returns the key of a record, or false if the record is missing
+// any of the key fields.
+func (d *deduper) recordKey(record map[string]interface{}) (string, bool, error) {
+	var values = []interface{}{}
+	for _, k := range d.key {
+		v, ok := record[k]
+		if !ok || v == nil {
+			return "", false, nil
+		}
+		values = append(values, v)
+	}
+
+	j, err := json.Marshal(values)
+	if err != nil {
+		return "", false, err
+	}
+	return string(j), true, nil
+}
+
+// Add reports whether record should be written now.
+func (d *deduper) Add(record map[string]interface{}) (bool, error) {
+	key, ok, err := d.recordKey(record)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		// Records without a key can't be deduplicated
+		return true, nil
+	}
+
+	stored, err := getDedupeRecord(d.db, d.scraper, key)
+	if err != nil {
+		return false, err
+	}
+
+	if d.strategy == dedupeFirst {
+		if stored != nil || d.unstored[key] {
+			d.duplicates++
+			return false, nil
+		}
+		j, err := json.Marshal(record)
+		if err != nil {
+			return false, err
+		}
+		putDedupeRecord(d.batch, d.scraper, key, j)
+		d.unstored[key] = true
+		return true, nil
+	}
+
+	if stored != nil && d.strategy == dedupeMerge {
+		var merged = make(map[string]interface{})
+		err = json.Unmarshal(stored, &merged)
+		if err != nil {
+			return false, err
+		}
+		for k, v := range record {
+			if !isEmptyValue(v) {
+				merged[k] = v
+			}
+		}
+		record = merged
+	}
+
+	j, err := json.Marshal(record)
+	if err != nil {
+		return false, err
+	}
+
+	if stored != nil {
+		pending, err := hasDedupePending(d.db, d.scraper, key)
+		if err != nil {
+			return false, err
+		}
+		if pending || bytes.Equal(stored, j) {
+			d.duplicates++
+		}
+		if !pending && bytes.Equal(stored, j) {
+			// Already written by a previous run
+			return false, nil
+		}
+	}
+
+	return false, storePendingDedupeRecord(d.db, d.scraper, key, j)
+}
+
+// stored is called once the batch has been written.
+func (d *deduper) stored() {
+	d.unstored = map[string]bool{}
+}
+
+// Flush writes the records held back during the run to output.
+func (d *deduper) Flush(output OutputSink) error {
+	iter := getDedupePendingIterator(d.db, d.scraper)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	prefix := len(dedupePendingKey(d.scraper, ""))
+	for iter.Next() {
+		key := string(iter.Key()[prefix:])
+		stored, err := getDedupeRecord(d.db, d.scraper, key)
+		if err != nil {
+			return err
+		}
+
+		var record = make(map[string]interface{})
+		err = json.Unmarshal(stored, &record)
+		if err != nil {
+			return err
+		}
+
+		err = output.Write(record)
+		if err != nil {
+			return err
+		}
+		d.flushed++
+
+		batch.Delete(iter.Key())
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return d.db.Write(batch, nil)
+}
+
+// isEmptyValue reports whether a field has no value, such as an XPath which
+// didn't match anything.
+func isEmptyValue(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return true
+	case string:
+		return value == ""
+	case []string:
+		return len(value) == 0
+	case []interface{}:
+		return len(value) == 0
+	case []map[string]interface{}:
+		return len(value) == 0
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func runDedupeScraper(t *testing.T, strategy string, output *ConfigOutput, pages []string) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Scrapers: []*ConfigScraper{
+			&ConfigScraper{
+				Name:    "Test",
+				Output:  output,
+				Context: "//div",
+				Fields: map[string]interface{}{
+					"id":    "./@id",
+					"title": "./span/text()",
+				},
+				Key:    []string{"id"},
+				Dedupe: strategy,
+			},
+		},
+	}
+
+	// Each page is scraped in a separate run
+	for i, p := range pages {
+		u, _ := url.Parse("foo.com/" + strconv.Itoa(i))
+		storeResult(testDB, &SpiderResult{
+			URL:      u,
+			Response: p,
+		})
+
+		err = RunScraper(testDB, rugFile, ScrapeOptions{})
+		assert.NoError(t, err)
+	}
+}
+
+// runDedupeSQLite runs a scraper with a sqlite output keyed on id, and
+// returns the rows of the output by id.
+func runDedupeSQLite(t *testing.T, strategy string, pages []string) [][]string {
+	defer os.Remove("test_dedupe.sqlite")
+	runDedupeScraper(t, strategy, &ConfigOutput{
+		Type:    outputSQLite,
+		Path:    "test_dedupe.sqlite",
+		Table:   "records",
+		Columns: []string{"id", "title"},
+		Key:     []string{"id"},
+	}, pages)
+
+	db, err := sql.Open("sqlite3", "test_dedupe.sqlite")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT id, title FROM records ORDER BY id`)
+	assert.NoError(t, err)
+	defer rows.Close()
+	var records = [][]string{}
+	for rows.Next() {
+		var id, title string
+		assert.NoError(t, rows.Scan(&id, &title))
+		records = append(records, []string{id, title})
+	}
+	assert.NoError(t, rows.Err())
+	return records
+}
+
+var dedupePages = []string{
+	`<html><body><div id="1"><span>title1</span></div><div id="1"></div><div id="2"><span>title2</span></div></body></html>`,
+	`<html><body><div id="1"><span>title3</span></div><div id="2"><span>title2</span></div></body></html>`,
+	`<html><body><div id="1"></div></body></html>`,
+}
+
+func TestDedupeFirst(t *testing.T) {
+	defer os.Remove("test_dedupe.jsonl")
+	runDedupeScraper(t, dedupeFirst, &ConfigOutput{Path: "test_dedupe.jsonl"}, dedupePages)
+	output, _ := ioutil.ReadFile("test_dedupe.jsonl")
+	assert.Equal(t, "{\"id\":\"1\",\"title\":\"title1\"}\n{\"id\":\"2\",\"title\":\"title2\"}\n", string(output))
+}
+
+func TestDedupeLast(t *testing.T) {
+	// Each key has one row, of the last record seen for it
+	records := runDedupeSQLite(t, dedupeLast, dedupePages)
+	assert.Equal(t, [][]string{{"1", "[]"}, {"2", "title2"}}, records)
+}
+
+func TestDedupeMerge(t *testing.T) {
+	// Each key has one row, with the non-empty fields of its records merged
+	records := runDedupeSQLite(t, dedupeMerge, dedupePages)
+	assert.Equal(t, [][]string{{"1", "title3"}, {"2", "title2"}}, records)
+}
+
+func TestDedupeRequiresUpsert(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	var config = &ConfigScraper{
+		Name:   "Test",
+		Output: &ConfigOutput{Path: "test_dedupe.jsonl"},
+		Key:    []string{"id"},
+		Dedupe: dedupeLast,
+	}
+	_, err = newDeduper(testDB, config, new(leveldb.Batch))
+	assert.EqualError(t, err, "Dedupe strategy \"last\" of scraper Test requires a sqlite output with the same key")
+
+	config.Output = &ConfigOutput{Type: outputSQLite, Path: "test_dedupe.sqlite", Key: []string{"url"}}
+	_, err = newDeduper(testDB, config, new(leveldb.Batch))
+	assert.Error(t, err)
+
+	config.Output.Key = []string{"id"}
+	_, err = newDeduper(testDB, config, new(leveldb.Batch))
+	assert.NoError(t, err)
+}
+
+func TestDedupeFirstStoredWithPages(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	var config = &ConfigScraper{Name: "Test", Key: []string{"id"}}
+	batch := new(leveldb.Batch)
+	d, err := newDeduper(testDB, config, batch)
+	assert.NoError(t, err)
+
+	write, err := d.Add(map[string]interface{}{"id": "1"})
+	assert.NoError(t, err)
+	assert.True(t, write)
+	write, err = d.Add(map[string]interface{}{"id": "1"})
+	assert.NoError(t, err)
+	assert.False(t, write)
+
+	// The key is only stored along with the pages it came from, so a run
+	// which crashes before then writes the record again
+	stored, err := getDedupeRecord(testDB, "Test", `["1"]`)
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	assert.NoError(t, testDB.Write(batch, nil))
+	batch.Reset()
+	d.stored()
+	write, err = d.Add(map[string]interface{}{"id": "1"})
+	assert.NoError(t, err)
+	assert.False(t, write)
+	assert.Equal(t, 2, d.duplicates)
+}
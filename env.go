@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// envFile is read from the directory of the config, and sets variables which
+// aren't set in the environment.
+const envFile = ".env"
+
+// secretMinLength is the length below which interpolated values aren't
+// treated as secrets, as redacting them would mangle everything else.
+const secretMinLength = 4
+
+// envPattern matches ${NAME} and ${NAME:-default}. $${NAME} is left as a
+// literal ${NAME}.
+var envPattern = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// readEnvFile reads the variables in a .env file. Lines are NAME=value, and
+// may start with export. Values may be quoted, and lines starting with # are
+// ignored. A missing file has no variables.
+func readEnvFile(path string) (map[string]string, error) {
+	var env = make(map[string]string)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return env, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	var n = 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("Invalid line %d in %s. Should be NAME=value.", n, path)
+		}
+		name := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[name] = value
+	}
+	return env, scanner.Err()
+}
+
+// interpolateConfig replaces variables in the string values of a config,
+// which has been converted into JSON. Variables are looked up in the
+// environment and then in env, and the values found are added to secrets.
+func interpolateConfig(data []byte, env map[string]string) ([]byte, []ConfigProblem, error) {
+	var raw interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var problems = configProblems{}
+	raw = interpolateValue(&problems, "", raw, env)
+	if len(problems) > 0 {
+		return nil, problems, nil
+	}
+
+	data, err = json.Marshal(raw)
+	return data, nil, err
+}
+
+func interpolateValue(p *configProblems, path string, v interface{}, env map[string]string) interface{} {
+	switch value := v.(type) {
+	case string:
+		return interpolate(p, path, value, env)
+	case map[string]interface{}:
+		for _, k := range sortedKeys(value) {
+			value[k] = interpolateValue(p, joinPath(path, k), value[k], env)
+		}
+	case []interface{}:
+		for i := range value {
+			value[i] = interpolateValue(p, fmt.Sprintf("%s[%d]", path, i), value[i], env)
+		}
+	}
+	return v
+}
+
+func interpolate(p *configProblems, path string, s string, env map[string]string) string {
+	return envPattern.ReplaceAllStringFunc(s, func(match string) string {
+		groups := envPattern.FindStringSubmatch(match)
+		if groups[1] != "" {
+			return match[1:]
+		}
+
+		name := groups[2]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			value, ok = env[name]
+		}
+		if ok && value != "" {
+			secrets.Add(name, value)
+			return value
+		}
+		if groups[3] != "" {
+			return strings.TrimPrefix(groups[3], ":-")
+		}
+		if ok {
+			return value
+		}
+		p.add(path, "environment variable %s isn't set", name)
+		return match
+	})
+}
+
+// secretSet holds the values interpolated into the config, so that they can
+// be kept out of the logs and the store. Values are redacted by replacing
+// them with the variable they came from, such as ${API_TOKEN}.
+type secretSet struct {
+	m      sync.RWMutex
+	values map[string]string
+}
+
+var secrets = &secretSet{values: map[string]string{}}
+
+func (s *secretSet) Add(name string, value string) {
+	if len(value) < secretMinLength {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.values[value] = name
+}
+
+// replacer returns a replacer for the secrets, or nil if there aren't any.
+// Longer values are replaced first, in case one contains another.
+func (s *secretSet) replacer(redact bool) *strings.Replacer {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if len(s.values) == 0 {
+		return nil
+	}
+
+	var values = []string{}
+	for v := range s.values {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+
+	var pairs = []string{}
+	for _, v := range values {
+		placeholder := "${" + s.values[v] + "}"
+		if redact {
+			pairs = append(pairs, v, placeholder)
+		} else {
+			pairs = append(pairs, placeholder, v)
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// Redact replaces any secrets in str with the variables they came from.
+func (s *secretSet) Redact(str string) string {
+	r := s.replacer(true)
+	if r == nil {
+		return str
+	}
+	return r.Replace(str)
+}
+
+// Expand replaces variables which were redacted from str with their values.
+func (s *secretSet) Expand(str string) string {
+	r := s.replacer(false)
+	if r == nil {
+		return str
+	}
+	return r.Replace(str)
+}
+
+// RedactURL returns a copy of u with any secrets redacted.
+func (s *secretSet) RedactURL(u *url.URL) *url.URL {
+	return mapURL(u, s.Redact)
+}
+
+// ExpandURL returns a copy of u with any redacted secrets expanded.
+func (s *secretSet) ExpandURL(u *url.URL) *url.URL {
+	return mapURL(u, s.Expand)
+}
+
+func mapURL(u *url.URL, fn func(string) string) *url.URL {
+	if u == nil {
+		return nil
+	}
+	mapped := *u
+	mapped.Opaque = fn(u.Opaque)
+	mapped.Host = fn(u.Host)
+	mapped.Path = fn(u.Path)
+	mapped.RawPath = fn(u.RawPath)
+	mapped.RawQuery = fn(u.RawQuery)
+	mapped.Fragment = fn(u.Fragment)
+	return &mapped
+}
+
+// RedactResult returns a copy of r with any secrets redacted from its URLs,
+// headers and error. The page itself is left as it is, as scrapers read it
+// and values such as host or user names may be part of its text.
+func (s *secretSet) RedactResult(r *SpiderResult) *SpiderResult {
+	redacted := *r
+	redacted.URL = s.RedactURL(r.URL)
+	redacted.Error = s.Redact(r.Error)
+	if r.Header != nil {
+		redacted.Header = http.Header{}
+		for k, values := range r.Header {
+			for _, v := range values {
+				redacted.Header.Add(k, s.Redact(v))
+			}
+		}
+	}
+	if r.Children != nil {
+		redacted.Children = []*url.URL{}
+		for _, u := range r.Children {
+			redacted.Children = append(redacted.Children, s.RedactURL(u))
+		}
+	}
+	return &redacted
+}
+
+// redactFormatter redacts secrets from log entries.
+type redactFormatter struct {
+	log.Formatter
+}
+
+func (f *redactFormatter) Format(entry *log.Entry) ([]byte, error) {
+	b, err := f.Formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(secrets.Redact(string(b))), nil
+}
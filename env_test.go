@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func resetSecrets() {
+	secrets = &secretSet{values: map[string]string{}}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rugburn")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, envFile)
+	err = ioutil.WriteFile(path, []byte("# Comment\nFOO=bar\nexport QUOTED=\"a b\"\n\nSINGLE='c'\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	env, err := readEnvFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"FOO": "bar", "QUOTED": "a b", "SINGLE": "c"}, env)
+
+	env, err = readEnvFile(filepath.Join(dir, "missing"))
+	assert.NoError(t, err)
+	assert.Len(t, env, 0)
+
+	err = ioutil.WriteFile(path, []byte("FOO\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	_, err = readEnvFile(path)
+	assert.Error(t, err)
+}
+
+func TestInterpolateConfig(t *testing.T) {
+	defer resetSecrets()
+	os.Setenv("RUGBURN_TEST_TOKEN", "s3cr3t-token")
+	defer os.Unsetenv("RUGBURN_TEST_TOKEN")
+
+	data, problems, err := interpolateConfig([]byte(`{
+		"urls": ["http://foo.com/?token=${RUGBURN_TEST_TOKEN}", "${RUGBURN_TEST_HOST:-http://bar.com}"],
+		"name": "${RUGBURN_TEST_FILE} $${RUGBURN_TEST_TOKEN}",
+		"max": 5
+	}`), map[string]string{"RUGBURN_TEST_FILE": "from-file", "RUGBURN_TEST_TOKEN": "ignored"})
+	assert.NoError(t, err)
+	assert.Len(t, problems, 0)
+	assert.JSONEq(t, `{
+		"urls": ["http://foo.com/?token=s3cr3t-token", "http://bar.com"],
+		"name": "from-file ${RUGBURN_TEST_TOKEN}",
+		"max": 5
+	}`, string(data))
+
+	// Values from the environment are secrets, defaults aren't
+	assert.Equal(t, "token=${RUGBURN_TEST_TOKEN} http://bar.com", secrets.Redact("token=s3cr3t-token http://bar.com"))
+	assert.Equal(t, "${RUGBURN_TEST_FILE}", secrets.Redact("from-file"))
+	assert.Equal(t, "token=s3cr3t-token", secrets.Expand("token=${RUGBURN_TEST_TOKEN}"))
+
+	_, problems, err = interpolateConfig([]byte(`{"spider": {"urls": ["${RUGBURN_TEST_MISSING}"]}}`), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []ConfigProblem{
+		{"spider.urls[0]", "environment variable RUGBURN_TEST_MISSING isn't set"},
+	}, problems)
+}
+
+func TestLoadRugFileEnv(t *testing.T) {
+	defer resetSecrets()
+	dir, err := ioutil.TempDir("", "rugburn")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "rug.yaml"), []byte(`
+name: ${RUGBURN_TEST_NAME}
+options:
+  spiders: {concurrency: 1}
+  store: {strategy: "${RUGBURN_TEST_STRATEGY:-memory}"}
+spider:
+  urls: ["http://foo.com/${RUGBURN_TEST_NAME}"]
+`), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, envFile), []byte("RUGBURN_TEST_NAME=from-env-file\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	rugFile, err := loadRugFile(filepath.Join(dir, "rug.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "from-env-file", rugFile.Name)
+	assert.Equal(t, strategyMem, rugFile.Options.StoreOptions.Strategy)
+	assert.Equal(t, []string{"http://foo.com/from-env-file"}, rugFile.Spider.URLs)
+
+	os.Remove(filepath.Join(dir, envFile))
+	_, err = loadRugFile(filepath.Join(dir, "rug.yaml"))
+	verr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Len(t, verr.Problems, 2)
+}
+
+func TestSecretsRedactedFromStore(t *testing.T) {
+	defer resetSecrets()
+	secrets.Add("RUGBURN_TEST_KEY", "k3y-value")
+
+	var requested = []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.String())
+		if r.URL.Query().Get("key") != "k3y-value" {
+			w.WriteHeader(403)
+			return
+		}
+		w.Header().Set("X-Key", "k3y-value")
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<a href="/next?key=k3y-value">next</a> k3y-value`))
+			return
+		}
+		w.Write([]byte(`done`))
+	}))
+	defer ts.Close()
+
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	err = RunSpider(testDB, &RugFile{
+		Name: "Test",
+		Options: &ConfigOptions{
+			SpiderOptions: &ConfigSpiderOptions{Concurrency: 1},
+			StoreOptions:  &ConfigStoreOptions{Strategy: strategyMem},
+		},
+		Spider: &ConfigSpider{
+			URLs:  []string{ts.URL + "/?key=k3y-value"},
+			Links: []*ConfigLinkRule{{XPath: "//a/@href"}},
+		},
+	}, CrawlOptions{})
+	assert.NoError(t, err)
+
+	// Secrets are expanded again when requests are made
+	assert.Equal(t, []string{"/?key=k3y-value", "/next?key=k3y-value"}, requested)
+
+	iter := testDB.NewIterator(&util.Range{}, nil)
+	defer iter.Release()
+	var n = 0
+	for iter.Next() {
+		n++
+		assert.False(t, bytes.Contains(iter.Key(), []byte("k3y-value")), string(iter.Key()))
+		if !bytes.HasPrefix(iter.Key(), []byte("res-")) {
+			assert.False(t, bytes.Contains(iter.Value(), []byte("k3y-value")), string(iter.Key()))
+			continue
+		}
+		// Pages are stored as they are, but their URLs are redacted
+		r, err := decodeResult(iter.Value())
+		assert.NoError(t, err)
+		r.Response = ""
+		var buffer = bytes.NewBuffer([]byte{})
+		assert.NoError(t, gob.NewEncoder(buffer).Encode(r))
+		assert.False(t, bytes.Contains(buffer.Bytes(), []byte("k3y-value")), string(iter.Key()))
+	}
+	assert.NotEqual(t, 0, n)
+
+	r, err := getStoredResult(testDB, "", ts.URL+"/?key=k3y-value")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, r.StatusCode)
+	assert.Equal(t, "key=${RUGBURN_TEST_KEY}", r.URL.RawQuery)
+	assert.Equal(t, "${RUGBURN_TEST_KEY}", r.Header.Get("X-Key"))
+	assert.Equal(t, "${RUGBURN_TEST_KEY}", r.Children[0].Query().Get("key"))
+	assert.Contains(t, r.Response, "k3y-value")
+}
+
+func TestSecretsKeptInScrapedPages(t *testing.T) {
+	defer resetSecrets()
+	secrets.Add("RUGBURN_TEST_USER", "alice-smith")
+
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	u, _ := url.Parse("http://foo.com/users/alice-smith")
+	err = storeResult(testDB, &SpiderResult{URL: u, Response: `<html><body><h1>alice-smith</h1></body></html>`})
+	assert.NoError(t, err)
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Options: &ConfigOptions{
+			StoreOptions: &ConfigStoreOptions{Strategy: strategyMem},
+		},
+		Scrapers: []*ConfigScraper{
+			&ConfigScraper{
+				Name:   "Test",
+				Output: &ConfigOutput{Path: "test_secrets.jsonl"},
+				Fields: map[string]interface{}{"name": "//h1/text()"},
+			},
+		},
+	}
+	defer os.Remove("test_secrets.jsonl")
+
+	err = RunScraper(testDB, rugFile, ScrapeOptions{})
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadFile("test_secrets.jsonl")
+	assert.Equal(t, "{\"name\":\"alice-smith\"}\n", string(b))
+}
+
+func TestSecretsRedactedFromLogs(t *testing.T) {
+	defer resetSecrets()
+	secrets.Add("RUGBURN_TEST_KEY", "k3y-value")
+
+	var buffer = bytes.NewBuffer([]byte{})
+	logger := log.New()
+	logger.Out = buffer
+	logger.Formatter = &redactFormatter{&log.TextFormatter{DisableColors: true}}
+	logger.Info(fmt.Sprintf("Fetching http://foo.com/?key=%s", "k3y-value"))
+
+	assert.Contains(t, buffer.String(), "key=${RUGBURN_TEST_KEY}")
+	assert.NotContains(t, buffer.String(), "k3y-value")
+}
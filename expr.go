@@ -0,0 +1,600 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expressions are a small language for declarative transforms, such as
+//
+//	lower(replace(title, ' ', '-'))
+//	price > 10 and not contains(title, 'sold')
+//
+// Identifiers refer to fields of the record, and dots refer to fields of
+// nested objects. Values scraped from pages are strings, so arithmetic and
+// ordering convert strings to numbers where they can.
+
+type exprFunc func(record map[string]interface{}) (interface{}, error)
+
+type exprTokenKind int
+
+const (
+	exprEOF exprTokenKind = iota
+	exprIdent
+	exprNumber
+	exprStr
+	exprOp
+)
+
+type exprToken struct {
+	kind  exprTokenKind
+	value string
+	pos   int
+}
+
+func lexExpr(s string) ([]exprToken, error) {
+	var tokens = []exprToken{}
+	var runes = []rune(s)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{exprIdent, string(runes[start:i]), start})
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{exprNumber, string(runes[start:i]), start})
+		case c == '\'' || c == '"':
+			start := i
+			var value = []rune{}
+			i++
+			for i < len(runes) && runes[i] != c {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value = append(value, runes[i])
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("Unterminated string at %d in expression \"%s\"", start, s)
+			}
+			i++
+			tokens = append(tokens, exprToken{exprStr, string(value), start})
+		default:
+			start := i
+			op := string(c)
+			if i+1 < len(runes) {
+				switch string(runes[i : i+2]) {
+				case "==", "!=", "<=", ">=":
+					op = string(runes[i : i+2])
+				}
+			}
+			if !strings.Contains("+-*/%()<>,", op) && len(op) == 1 {
+				return nil, fmt.Errorf("Unexpected \"%s\" at %d in expression \"%s\"", op, start, s)
+			}
+			i += len(op)
+			tokens = append(tokens, exprToken{exprOp, op, start})
+		}
+	}
+	return append(tokens, exprToken{exprEOF, "", len(runes)}), nil
+}
+
+type exprParser struct {
+	source string
+	tokens []exprToken
+	pos    int
+}
+
+// compileExpr parses an expression into a function evaluating it against a
+// record.
+func compileExpr(s string) (exprFunc, error) {
+	tokens, err := lexExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{source: s, tokens: tokens}
+	fn, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != exprEOF {
+		return nil, p.unexpected()
+	}
+	return fn, nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != exprEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != exprOp && t.kind != exprIdent {
+		return false
+	}
+	for _, op := range ops {
+		if t.value == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) unexpected() error {
+	t := p.peek()
+	if t.kind == exprEOF {
+		return fmt.Errorf("Unexpected end of expression \"%s\"", p.source)
+	}
+	return fmt.Errorf("Unexpected \"%s\" at %d in expression \"%s\"", t.value, t.pos, p.source)
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.isOp(op) {
+		return p.unexpected()
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprFunc, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = exprLogical(left, right, true)
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprFunc, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = exprLogical(left, right, false)
+	}
+	return left, nil
+}
+
+func exprLogical(left exprFunc, right exprFunc, or bool) exprFunc {
+	return func(record map[string]interface{}) (interface{}, error) {
+		l, err := left(record)
+		if err != nil {
+			return nil, err
+		}
+		if exprTruthy(l) == or {
+			return or, nil
+		}
+		r, err := right(record)
+		if err != nil {
+			return nil, err
+		}
+		return exprTruthy(r), nil
+	}
+}
+
+func (p *exprParser) parseNot() (exprFunc, error) {
+	if p.isOp("not") {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(record map[string]interface{}) (interface{}, error) {
+			v, err := operand(record)
+			if err != nil {
+				return nil, err
+			}
+			return !exprTruthy(v), nil
+		}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprFunc, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOp("==", "!=", "<", "<=", ">", ">=") {
+		op := p.next().value
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return func(record map[string]interface{}) (interface{}, error) {
+			l, err := left(record)
+			if err != nil {
+				return nil, err
+			}
+			r, err := right(record)
+			if err != nil {
+				return nil, err
+			}
+			return exprCompare(op, l, r), nil
+		}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAdditive() (exprFunc, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+", "-") {
+		op := p.next().value
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = exprArithmetic(op, left, right)
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseMultiplicative() (exprFunc, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*", "/", "%") {
+		op := p.next().value
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = exprArithmetic(op, left, right)
+	}
+	return left, nil
+}
+
+func exprArithmetic(op string, left exprFunc, right exprFunc) exprFunc {
+	return func(record map[string]interface{}) (interface{}, error) {
+		lv, err := left(record)
+		if err != nil {
+			return nil, err
+		}
+		rv, err := right(record)
+		if err != nil {
+			return nil, err
+		}
+		l, lok := exprNumberValue(lv)
+		r, rok := exprNumberValue(rv)
+		if !lok || !rok {
+			return nil, fmt.Errorf("Can't apply \"%s\" to %v and %v", op, lv, rv)
+		}
+		switch op {
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		}
+		if r == 0 || (op == "%" && int64(r) == 0) {
+			return nil, fmt.Errorf("Division by zero")
+		}
+		if op == "/" {
+			return l / r, nil
+		}
+		return float64(int64(l) % int64(r)), nil
+	}
+}
+
+func (p *exprParser) parseUnary() (exprFunc, error) {
+	if p.isOp("-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(record map[string]interface{}) (interface{}, error) {
+			v, err := operand(record)
+			if err != nil {
+				return nil, err
+			}
+			n, ok := exprNumberValue(v)
+			if !ok {
+				return nil, fmt.Errorf("Can't negate %v", v)
+			}
+			return -n, nil
+		}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprFunc, error) {
+	t := p.next()
+	switch t.kind {
+	case exprNumber:
+		n, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number \"%s\" at %d in expression \"%s\"", t.value, t.pos, p.source)
+		}
+		return exprConst(n), nil
+	case exprStr:
+		return exprConst(t.value), nil
+	case exprOp:
+		if t.value == "(" {
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		}
+	case exprIdent:
+		switch t.value {
+		case "true":
+			return exprConst(true), nil
+		case "false":
+			return exprConst(false), nil
+		case "null", "nil":
+			return exprConst(nil), nil
+		case "and", "or", "not":
+			p.pos--
+			return nil, p.unexpected()
+		}
+		if p.isOp("(") {
+			return p.parseCall(t)
+		}
+		path := strings.Split(t.value, ".")
+		return func(record map[string]interface{}) (interface{}, error) {
+			return exprField(record, path), nil
+		}, nil
+	}
+	if t.kind != exprEOF {
+		p.pos--
+	}
+	return nil, p.unexpected()
+}
+
+func (p *exprParser) parseCall(name exprToken) (exprFunc, error) {
+	fn, ok := exprFuncs[name.value]
+	if !ok {
+		return nil, fmt.Errorf("Unknown function \"%s\" at %d in expression \"%s\"", name.value, name.pos, p.source)
+	}
+	p.next()
+
+	var args = []exprFunc{}
+	if !p.isOp(")") {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if !p.isOp(",") {
+				break
+			}
+			p.next()
+		}
+	}
+	err := p.expect(")")
+	if err != nil {
+		return nil, err
+	}
+
+	return func(record map[string]interface{}) (interface{}, error) {
+		var values = []interface{}{}
+		for _, arg := range args {
+			v, err := arg(record)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return fn(values)
+	}, nil
+}
+
+func exprConst(v interface{}) exprFunc {
+	return func(record map[string]interface{}) (interface{}, error) {
+		return v, nil
+	}
+}
+
+func exprField(record map[string]interface{}, path []string) interface{} {
+	var v interface{} = record
+	for _, k := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+func exprTruthy(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case string:
+		return value != ""
+	case float64:
+		return value != 0
+	}
+	return true
+}
+
+func exprNumberValue(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case int:
+		return float64(value), true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func exprString(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	s, _ := formatValue(v)
+	return s
+}
+
+func exprCompare(op string, l interface{}, r interface{}) bool {
+	ln, lok := exprNumberValue(l)
+	rn, rok := exprNumberValue(r)
+	_, lstring := l.(string)
+	_, rstring := r.(string)
+	numeric := lok && rok && !(lstring && rstring)
+
+	switch op {
+	case "==", "!=":
+		var equal bool
+		if l == nil || r == nil {
+			equal = l == nil && r == nil
+		} else if numeric {
+			equal = ln == rn
+		} else {
+			equal = exprString(l) == exprString(r)
+		}
+		return equal == (op == "==")
+	}
+
+	var c int
+	if numeric {
+		switch {
+		case ln < rn:
+			c = -1
+		case ln > rn:
+			c = 1
+		}
+	} else if lstring && rstring {
+		c = strings.Compare(l.(string), r.(string))
+	} else {
+		// Values which can't be ordered never match
+		return false
+	}
+
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+func exprArgs(name string, args []interface{}, n int) error {
+	if len(args) != n {
+		return fmt.Errorf("%s expects %d arguments but got %d", name, n, len(args))
+	}
+	return nil
+}
+
+var exprFuncs = map[string]func(args []interface{}) (interface{}, error){
+	"lower": func(args []interface{}) (interface{}, error) {
+		if err := exprArgs("lower", args, 1); err != nil {
+			return nil, err
+		}
+		return strings.ToLower(exprString(args[0])), nil
+	},
+	"upper": func(args []interface{}) (interface{}, error) {
+		if err := exprArgs("upper", args, 1); err != nil {
+			return nil, err
+		}
+		return strings.ToUpper(exprString(args[0])), nil
+	},
+	"trim": func(args []interface{}) (interface{}, error) {
+		if err := exprArgs("trim", args, 1); err != nil {
+			return nil, err
+		}
+		return strings.TrimSpace(exprString(args[0])), nil
+	},
+	"replace": func(args []interface{}) (interface{}, error) {
+		if err := exprArgs("replace", args, 3); err != nil {
+			return nil, err
+		}
+		return strings.Replace(exprString(args[0]), exprString(args[1]), exprString(args[2]), -1), nil
+	},
+	"contains": func(args []interface{}) (interface{}, error) {
+		if err := exprArgs("contains", args, 2); err != nil {
+			return nil, err
+		}
+		return strings.Contains(exprString(args[0]), exprString(args[1])), nil
+	},
+	"concat": func(args []interface{}) (interface{}, error) {
+		var parts = []string{}
+		for _, a := range args {
+			parts = append(parts, exprString(a))
+		}
+		return strings.Join(parts, ""), nil
+	},
+	"len": func(args []interface{}) (interface{}, error) {
+		if err := exprArgs("len", args, 1); err != nil {
+			return nil, err
+		}
+		switch value := args[0].(type) {
+		case []string:
+			return float64(len(value)), nil
+		case []interface{}:
+			return float64(len(value)), nil
+		case []map[string]interface{}:
+			return float64(len(value)), nil
+		}
+		return float64(len([]rune(exprString(args[0])))), nil
+	},
+	"number": func(args []interface{}) (interface{}, error) {
+		if err := exprArgs("number", args, 1); err != nil {
+			return nil, err
+		}
+		n, ok := exprNumberValue(args[0])
+		if !ok {
+			return nil, nil
+		}
+		return n, nil
+	},
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpr(t *testing.T) {
+	var record = map[string]interface{}{
+		"title": " Hello World ",
+		"price": "12.50",
+		"tags":  []string{"a", "b"},
+		"meta": map[string]interface{}{
+			"author": "bryce",
+		},
+	}
+
+	var tests = []struct {
+		expr   string
+		result interface{}
+	}{
+		{"lower(trim(title))", "hello world"},
+		{"replace(trim(title), ' ', '-')", "Hello-World"},
+		{"price * 2", float64(25)},
+		{"-price + 1", float64(-11.5)},
+		{"(1 + 2) * 3 % 4", float64(1)},
+		{"price > 10", true},
+		{"price > 10 and not contains(title, 'World')", false},
+		{"price < 10 or len(tags) == 2", true},
+		{"meta.author == \"bryce\"", true},
+		{"missing == null", true},
+		{"missing.field", nil},
+		{"concat(meta.author, ':', len(tags))", "bryce:2"},
+		{"'b' > 'a'", true},
+		{"number('abc')", nil},
+	}
+
+	for _, test := range tests {
+		fn, err := compileExpr(test.expr)
+		if !assert.NoError(t, err, test.expr) {
+			continue
+		}
+		v, err := fn(record)
+		assert.NoError(t, err, test.expr)
+		assert.Equal(t, test.result, v, test.expr)
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for _, expr := range []string{"", "title ==", "lower(title", "foo(title)", "'open", "a = b", "and"} {
+		_, err := compileExpr(expr)
+		assert.Error(t, err, expr)
+	}
+
+	fn, err := compileExpr("title * 2")
+	assert.NoError(t, err)
+	_, err = fn(map[string]interface{}{"title": "abc"})
+	assert.Error(t, err)
+
+	fn, err = compileExpr("1 % 0")
+	assert.NoError(t, err)
+	_, err = fn(map[string]interface{}{})
+	assert.Error(t, err)
+}
+
+func TestExprTransform(t *testing.T) {
+	transform, err := NewExprTransform("Links.transforms[0]", &ConfigTransform{
+		Where: "price > 10",
+		Set: map[string]string{
+			"slug":  "lower(title)",
+			"title": "upper(title)",
+		},
+		Rename: map[string]string{"price": "cost"},
+		Drop:   []string{"internal"},
+	})
+	assert.NoError(t, err)
+
+	result, err := transform.Apply(map[string]interface{}{
+		"title":    "Foo",
+		"price":    "20",
+		"internal": "x",
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]interface{}{{
+		"title": "FOO",
+		"slug":  "foo",
+		"cost":  "20",
+	}}, result)
+
+	result, err = transform.Apply(map[string]interface{}{"title": "Bar", "price": "5"}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, result, 0)
+
+	_, err = NewExprTransform("Links.transforms[0]", &ConfigTransform{Where: "price >"})
+	assert.Error(t, err)
+}
+
+func TestExprTransformRename(t *testing.T) {
+	transform, err := NewExprTransform("Links.transforms[0]", &ConfigTransform{
+		Rename: map[string]string{"a": "b", "b": "c", "x": "y", "y": "x"},
+	})
+	assert.NoError(t, err)
+
+	// Renames which chain or swap fields see the record before any renames,
+	// whatever order the map is iterated in
+	for i := 0; i < 20; i++ {
+		result, err := transform.Apply(map[string]interface{}{"a": "1", "b": "2", "x": "3", "y": "4"}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []map[string]interface{}{{"b": "1", "c": "2", "x": "4", "y": "3"}}, result)
+	}
+}
+
+func TestConfigTransformUnmarshal(t *testing.T) {
+	var transforms = []*ConfigTransform{}
+	err := json.Unmarshal([]byte(`[
+		"transforms/clean.lua",
+		{"lua": "function transform(r) return r end"},
+		{"set": {"slug": "lower(title)"}, "drop": ["id"]}
+	]`), &transforms)
+	assert.NoError(t, err)
+	assert.Equal(t, "transforms/clean.lua", transforms[0].Path)
+	assert.Equal(t, "function transform(r) return r end", transforms[1].Lua)
+	assert.Equal(t, map[string]string{"slug": "lower(title)"}, transforms[2].Set)
+	assert.Equal(t, []string{"id"}, transforms[2].Drop)
+
+	_, _, err = loadTransform("Links.transforms[0]", &ConfigTransform{
+		Lua: "function transform(r) return r end",
+		Set: map[string]string{"slug": "lower(title)"},
+	}, TransformLimits{})
+	assert.Error(t, err)
+
+	transform, _, err := loadTransform("Links.transforms[1]", transforms[1], TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+	assert.Equal(t, "Links.transforms[1]", transform.Name())
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const orderBFS = "bfs"
+const orderDFS = "dfs"
+const orderPriority = "priority"
+
+// frontierBatchSize is how many requests are written at once when the
+// frontier is rebuilt.
+const frontierBatchSize = 1000
+
+// frontier is the queue of requests of a spider, stored in leveldb so that
+// it survives restarts. Requests are stored under keys which sort in the
+// order they should be made:
+//
+//	bfs       by depth, then in the order they were found
+//	dfs       most recently found first
+//	priority  by the priority of their link rule, highest first, then as bfs
+//
+// Requests stay in the frontier until Done is called, so requests which were
+// in flight when a run stopped are made again by the next run. The req- key
+// of each request holds its frontier key. The frontier also moves the URLs
+// of its requests through their crawl states, and URLs are only queued once.
+type frontier struct {
+	db     *leveldb.DB
+	spider string
+	order  string
+	seq    uint64
+	state  *crawlState
+}
+
+func frontierPrefix(spider string) []byte {
+	return []byte("frn-" + spider + "|")
+}
+
+func frontierSeqKey(spider string) []byte {
+	return []byte("frs-" + spider)
+}
+
+func frontierOrderKey(spider string) []byte {
+	return []byte("fro-" + spider)
+}
+
+// frontierMigratedKey is set once the requests of a spider stored before the
+// frontier existed have been moved into it.
+func frontierMigratedKey(spider string) []byte {
+	return []byte("frm-" + spider)
+}
+
+// openFrontier opens the frontier of a spider. Requests queued by an older
+// version of rugburn are moved into it, it is rebuilt if the order has
+// changed since the last run, and requests which were in flight when the last
+// run stopped are queued again.
+func openFrontier(db *leveldb.DB, spider string, order string) (*frontier, error) {
+	if order == "" {
+		order = orderBFS
+	}
+	f := &frontier{db: db, spider: spider, order: order}
+
+	v, err := db.Get(frontierSeqKey(spider), nil)
+	if err != nil && err != lerrors.ErrNotFound {
+		return nil, err
+	}
+	if v != nil {
+		f.seq, err = strconv.ParseUint(string(v), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = f.migrate()
+	if err != nil {
+		return nil, err
+	}
+
+	f.state, err = openCrawlState(db, spider)
+	if err != nil {
+		return nil, err
+	}
+	err = f.state.requeue()
+	if err != nil {
+		return nil, err
+	}
+
+	v, err = db.Get(frontierOrderKey(spider), nil)
+	if err != nil && err != lerrors.ErrNotFound {
+		return nil, err
+	}
+	if v != nil && string(v) != order {
+		log.Infof("Order changed from %s to %s, rebuilding the queue..", v, order)
+		err = f.rebuild()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, db.Put(frontierOrderKey(spider), []byte(order), nil)
+}
+
+// key returns the frontier key of a request, which sorts in the order of the
+// frontier.
+func (f *frontier) key(r *SpiderRequest, seq uint64) []byte {
+	var key = append([]byte{}, frontierPrefix(f.spider)...)
+	switch f.order {
+	case orderDFS:
+		key = appendUint64(key, ^seq)
+	case orderPriority:
+		key = appendUint64(key, ^sortableInt(r.Priority))
+		key = appendUint64(key, uint64(r.Depth))
+		key = appendUint64(key, seq)
+	default:
+		key = appendUint64(key, uint64(r.Depth))
+		key = appendUint64(key, seq)
+	}
+	return key
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// sortableInt maps an int to a uint64 which sorts in the same order.
+func sortableInt(v int) uint64 {
+	return uint64(int64(v)) ^ (1 << 63)
+}
+
+// Counts returns how many URLs of the spider are in each crawl state.
+func (f *frontier) Counts() CrawlCounts {
+	return f.state.counts
+}
+
+// Push queues a request, unless its URL has been found before. URLs which
+// can't be fetched are skipped instead.
+func (f *frontier) Push(r *SpiderRequest) error {
+	batch := new(leveldb.Batch)
+	err := f.push(batch, r, map[string]bool{})
+	if err != nil {
+		return err
+	}
+	return f.db.Write(batch, nil)
+}
+
+// push is Push in a batch, so that the children of a result can be queued in
+// the same batch as the result. Since states set in the batch can't be read
+// until it is written, the URLs pushed in it are kept in seen.
+func (f *frontier) push(batch *leveldb.Batch, r *SpiderRequest, seen map[string]bool) error {
+	key := string(stateKey(f.spider, r.URL))
+	if seen[key] {
+		return nil
+	}
+	state, err := f.state.get(r.URL)
+	if err != nil || state != "" {
+		return err
+	}
+	seen[key] = true
+
+	if !fetchable(r.URL) {
+		log.Debugf("Skipping %s", r.URL)
+		return f.state.set(batch, r.URL, "", stateSkipped)
+	}
+	err = f.put(batch, r)
+	if err != nil {
+		return err
+	}
+	return f.state.set(batch, r.URL, "", stateQueued)
+}
+
+func (f *frontier) put(batch *leveldb.Batch, r *SpiderRequest) error {
+	var redacted = *r
+	redacted.URL = secrets.RedactURL(r.URL)
+	var buffer = bytes.NewBuffer([]byte{})
+	err := gob.NewEncoder(buffer).Encode(&redacted)
+	if err != nil {
+		return err
+	}
+
+	f.seq++
+	key := f.key(r, f.seq)
+	batch.Put(key, buffer.Bytes())
+	batch.Put(requestKey(f.spider, r.URL), key)
+	batch.Put(frontierSeqKey(f.spider), []byte(strconv.FormatUint(f.seq, 10)))
+	return nil
+}
+
+// Next returns up to n requests in the order of the frontier, skipping those
+// in skip, which are keyed by their frontier key.
+func (f *frontier) Next(n int, skip map[string]*SpiderRequest) ([]*SpiderRequest, error) {
+	var requests = []*SpiderRequest{}
+	if n <= 0 {
+		return requests, nil
+	}
+
+	iter := f.db.NewIterator(util.BytesPrefix(frontierPrefix(f.spider)), nil)
+	defer iter.Release()
+	for len(requests) < n && iter.Next() {
+		if _, ok := skip[string(iter.Key())]; ok {
+			continue
+		}
+		r, err := decodeRequest(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		r.URL = secrets.ExpandURL(r.URL)
+		r.key = append([]byte{}, iter.Key()...)
+		requests = append(requests, r)
+	}
+	return requests, iter.Error()
+}
+
+// Start sets the state of requests returned by Next to in flight.
+func (f *frontier) Start(requests ...*SpiderRequest) error {
+	batch := new(leveldb.Batch)
+	for _, r := range requests {
+		from, err := f.state.get(r.URL)
+		if err != nil {
+			return err
+		}
+		err = f.state.set(batch, r.URL, from, stateInFlight)
+		if err != nil {
+			return err
+		}
+	}
+	return f.db.Write(batch, nil)
+}
+
+// Done removes a request returned by Next from the frontier, and sets the
+// state of its URL.
+func (f *frontier) Done(r *SpiderRequest, state string) error {
+	batch := new(leveldb.Batch)
+	err := f.done(batch, r, state)
+	if err != nil {
+		return err
+	}
+	return f.db.Write(batch, nil)
+}
+
+// done is Done in a batch, so that the result of the request can be stored
+// in the same batch.
+func (f *frontier) done(batch *leveldb.Batch, r *SpiderRequest, state string) error {
+	from, err := f.state.get(r.URL)
+	if err != nil {
+		return err
+	}
+	batch.Delete(r.key)
+	batch.Delete(requestKey(f.spider, r.URL))
+	return f.state.set(batch, r.URL, from, state)
+}
+
+func decodeRequest(v []byte) (*SpiderRequest, error) {
+	var r = &SpiderRequest{}
+	err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// migrate moves requests which were stored under their req- keys, before
+// the frontier existed, into the frontier. It only looks for them once.
+func (f *frontier) migrate() error {
+	migrated, err := f.db.Has(frontierMigratedKey(f.spider), nil)
+	if err != nil || migrated {
+		return err
+	}
+
+	iter := f.db.NewIterator(util.BytesPrefix([]byte("req-"+spiderKey(f.spider, ""))), nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	var n = 0
+	for iter.Next() {
+		if bytes.HasPrefix(iter.Value(), []byte("frn-")) {
+			continue
+		}
+		r, err := decodeRequest(iter.Value())
+		if err != nil {
+			return err
+		}
+		if r.Spider != f.spider {
+			// A request of a named spider, under the prefix of the unnamed one
+			continue
+		}
+		r.URL = secrets.ExpandURL(r.URL)
+		err = f.put(batch, r)
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Infof("Moved %d queued requests into the queue", n)
+	}
+	batch.Put(frontierMigratedKey(f.spider), []byte{})
+	return f.db.Write(batch, nil)
+}
+
+// rebuild stores every request in the frontier again under a key for the
+// current order.
+func (f *frontier) rebuild() error {
+	iter := f.db.NewIterator(util.BytesPrefix(frontierPrefix(f.spider)), nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		r, err := decodeRequest(iter.Value())
+		if err != nil {
+			return err
+		}
+		r.URL = secrets.ExpandURL(r.URL)
+		batch.Delete(iter.Key())
+		err = f.put(batch, r)
+		if err != nil {
+			return err
+		}
+		if batch.Len() >= frontierBatchSize {
+			err = f.db.Write(batch, nil)
+			if err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return f.db.Write(batch, nil)
+}
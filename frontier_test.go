@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func pushRequests(f *frontier, requests ...*SpiderRequest) {
+	for _, r := range requests {
+		err := f.Push(r)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func testRequest(path string, depth int, priority int) *SpiderRequest {
+	u, _ := url.Parse("http://foo.com" + path)
+	return &SpiderRequest{URL: u, Depth: depth, Priority: priority}
+}
+
+func frontierPaths(t *testing.T, f *frontier) []string {
+	requests, err := f.Next(100, nil)
+	assert.NoError(t, err)
+	var paths = []string{}
+	for _, r := range requests {
+		paths = append(paths, r.URL.Path)
+	}
+	return paths
+}
+
+func TestFrontierOrders(t *testing.T) {
+	for order, expected := range map[string][]string{
+		orderBFS:      {"/a", "/c", "/b", "/e", "/d"},
+		orderDFS:      {"/e", "/d", "/c", "/b", "/a"},
+		orderPriority: {"/d", "/c", "/b", "/a", "/e"},
+	} {
+		testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+		if err != nil {
+			panic(err)
+		}
+
+		f, err := openFrontier(testDB, "", order)
+		assert.NoError(t, err)
+		pushRequests(f,
+			testRequest("/a", 0, 0),
+			testRequest("/b", 1, 5),
+			testRequest("/c", 0, 5),
+			testRequest("/d", 2, 10),
+			testRequest("/e", 1, 0),
+			testRequest("/a", 3, 100),
+		)
+		assert.Equal(t, expected, frontierPaths(t, f), order)
+		testDB.Close()
+	}
+}
+
+func TestFrontierPersists(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	f, err := openFrontier(testDB, "blog", orderBFS)
+	assert.NoError(t, err)
+	pushRequests(f, testRequest("/a", 0, 0), testRequest("/b", 1, 0), testRequest("/c", 1, 0))
+
+	requests, err := f.Next(2, nil)
+	assert.NoError(t, err)
+	assert.Len(t, requests, 2)
+
+	// In-flight requests are skipped, and done ones removed
+	var pending = map[string]*SpiderRequest{string(requests[1].key): requests[1]}
+	assert.NoError(t, f.Done(requests[0], stateDone))
+	next, err := f.Next(2, pending)
+	assert.NoError(t, err)
+	assert.Len(t, next, 1)
+	assert.Equal(t, "/c", next[0].URL.Path)
+
+	// Requests which were in flight are made again after a restart, after
+	// those queued before them
+	f, err = openFrontier(testDB, "blog", orderBFS)
+	assert.NoError(t, err)
+	pushRequests(f, testRequest("/d", 0, 0), testRequest("/b", 0, 0))
+	assert.Equal(t, []string{"/d", "/b", "/c"}, frontierPaths(t, f))
+
+	// Other spiders have their own frontier
+	other, err := openFrontier(testDB, "", orderBFS)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, frontierPaths(t, other))
+}
+
+func TestStoreResultQueuesChildren(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	f, err := openFrontier(testDB, "blog", orderBFS)
+	assert.NoError(t, err)
+	pushRequests(f, testRequest("/a", 0, 0))
+	requests, err := f.Next(1, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Start(requests...))
+
+	m := &spiderManager{
+		name:     "blog",
+		frontier: f,
+		pending:  map[string]*SpiderRequest{string(requests[0].key): requests[0]},
+		progress: newCrawlProgress(),
+	}
+	mail, _ := url.Parse("mailto:foo@foo.com")
+	err = m.storeResult(testDB, &SpiderResult{
+		URL:     requests[0].URL,
+		Spider:  "blog",
+		request: requests[0],
+		requests: []*SpiderRequest{
+			testRequest("/a", 1, 0),
+			testRequest("/b", 1, 0),
+			testRequest("/b", 1, 0),
+			{URL: mail, Depth: 1},
+		},
+	})
+	assert.NoError(t, err)
+
+	// Children found twice, or whose URL is the result's, are queued once
+	assert.Equal(t, CrawlCounts{Queued: 1, Done: 1, Skipped: 1}, f.Counts())
+	assert.Equal(t, []string{"/b"}, frontierPaths(t, f))
+
+	f, err = openFrontier(testDB, "blog", orderBFS)
+	assert.NoError(t, err)
+	assert.Equal(t, CrawlCounts{Queued: 1, Done: 1, Skipped: 1}, f.Counts())
+}
+
+func TestFrontierOrderChanged(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	f, err := openFrontier(testDB, "", orderBFS)
+	assert.NoError(t, err)
+	pushRequests(f, testRequest("/a", 0, 0), testRequest("/b", 1, 10))
+	assert.Equal(t, []string{"/a", "/b"}, frontierPaths(t, f))
+
+	f, err = openFrontier(testDB, "", orderPriority)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/b", "/a"}, frontierPaths(t, f))
+
+	// Each request is still only queued once
+	pushRequests(f, testRequest("/a", 0, 0))
+	assert.Equal(t, []string{"/b", "/a"}, frontierPaths(t, f))
+}
+
+func TestFrontierMigrates(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	// Requests as they were stored before the frontier
+	for _, r := range []*SpiderRequest{testRequest("/a", 0, 0), testRequest("/b", 0, 0)} {
+		var buffer = bytes.NewBuffer([]byte{})
+		err = gob.NewEncoder(buffer).Encode(r)
+		if err != nil {
+			panic(err)
+		}
+		err = testDB.Put(requestKey("", r.URL), buffer.Bytes(), nil)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	f, err := openFrontier(testDB, "", orderBFS)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/a", "/b"}, frontierPaths(t, f))
+
+	f, err = openFrontier(testDB, "", orderBFS)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/a", "/b"}, frontierPaths(t, f))
+
+	// Once migrated, the old keys aren't looked at again
+	has, err := testDB.Has(frontierMigratedKey(""), nil)
+	assert.NoError(t, err)
+	assert.True(t, has)
+
+	var buffer = bytes.NewBuffer([]byte{})
+	err = gob.NewEncoder(buffer).Encode(testRequest("/c", 0, 0))
+	if err != nil {
+		panic(err)
+	}
+	err = testDB.Put(requestKey("", testRequest("/c", 0, 0).URL), buffer.Bytes(), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	f, err = openFrontier(testDB, "", orderBFS)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/a", "/b"}, frontierPaths(t, f))
+}
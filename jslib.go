@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash"
+	"html"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+	log "github.com/sirupsen/logrus"
+)
+
+// newJSRugburn creates the rugburn global of JavaScript transforms. It has the
+// parts of the Lua rugburn module which JavaScript doesn't already provide.
+func newJSRugburn(vm *goja.Runtime, ctx *transformCallContext) *goja.Object {
+	rugburn := vm.NewObject()
+
+	// Times are Unix timestamps in seconds, as they are for Lua transforms
+	timeLib := vm.NewObject()
+	timeLib.Set("parse", func(layout string, s string) (float64, error) {
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return 0, err
+		}
+		return float64(t.UnixNano()) / float64(time.Second), nil
+	})
+	timeLib.Set("format", func(layout string, seconds float64) string {
+		return time.Unix(0, int64(seconds*float64(time.Second))).UTC().Format(layout)
+	})
+	timeLib.Set("now", func() float64 {
+		return float64(time.Now().UnixNano()) / float64(time.Second)
+	})
+	rugburn.Set("time", timeLib)
+
+	urlLib := vm.NewObject()
+	urlLib.Set("parse", func(s string) (*goja.Object, error) {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		o := vm.NewObject()
+		o.Set("scheme", u.Scheme)
+		o.Set("host", u.Hostname())
+		o.Set("port", u.Port())
+		o.Set("path", u.Path)
+		o.Set("rawQuery", u.RawQuery)
+		o.Set("query", jsQuery(vm, u.Query()))
+		o.Set("fragment", u.Fragment)
+		return o, nil
+	})
+	urlLib.Set("resolve", func(base string, ref string) (string, error) {
+		b, err := url.Parse(base)
+		if err != nil {
+			return "", err
+		}
+		r, err := url.Parse(ref)
+		if err != nil {
+			return "", err
+		}
+		return b.ResolveReference(r).String(), nil
+	})
+	urlLib.Set("query", func(s string) (*goja.Object, error) {
+		if i := strings.Index(s, "?"); i >= 0 {
+			s = s[i+1:]
+		}
+		values, err := url.ParseQuery(s)
+		if err != nil {
+			return nil, err
+		}
+		return jsQuery(vm, values), nil
+	})
+	rugburn.Set("url", urlLib)
+
+	hashLib := vm.NewObject()
+	hashLib.Set("sha1", jsHashFunc(sha1.New))
+	hashLib.Set("md5", jsHashFunc(md5.New))
+	rugburn.Set("hash", hashLib)
+
+	htmlLib := vm.NewObject()
+	htmlLib.Set("unescape", html.UnescapeString)
+	htmlLib.Set("stripTags", stripTags)
+	rugburn.Set("html", htmlLib)
+
+	logLib := vm.NewObject()
+	logFunc := func(fn func(entry *log.Entry, args ...interface{})) func(msg string) {
+		return func(msg string) {
+			fn(log.WithFields(ctx.fields()), msg)
+		}
+	}
+	logLib.Set("debug", logFunc((*log.Entry).Debug))
+	logLib.Set("info", logFunc((*log.Entry).Info))
+	logLib.Set("warn", logFunc((*log.Entry).Warn))
+	logLib.Set("error", logFunc((*log.Entry).Error))
+	rugburn.Set("log", logLib)
+
+	return rugburn
+}
+
+func jsStringArray(vm *goja.Runtime, values []string) goja.Value {
+	var items = []interface{}{}
+	for _, v := range values {
+		items = append(items, v)
+	}
+	return vm.NewArray(items...)
+}
+
+func jsQuery(vm *goja.Runtime, values url.Values) *goja.Object {
+	o := vm.NewObject()
+	for k, v := range values {
+		if len(v) == 1 {
+			o.Set(k, v[0])
+			continue
+		}
+		o.Set(k, jsStringArray(vm, v))
+	}
+	return o
+}
+
+func jsHashFunc(newHash func() hash.Hash) func(s string) string {
+	return func(s string) string {
+		h := newHash()
+		h.Write([]byte(s))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dop251/goja"
+)
+
+// JSTransform is a JavaScript transform with the same contract as a Lua
+// transform. It defines a transform function, and optionally init and finish
+// functions, and runs on a pool of warmed runtimes so that globals persist
+// for the whole scraper run.
+type JSTransform struct {
+	name     string
+	program  *goja.Program
+	limits   TransformLimits
+	finishes bool
+	m        sync.Mutex
+	pool     []*jsState
+}
+
+type jsState struct {
+	vm        *goja.Runtime
+	ctx       *transformCallContext
+	transform goja.Callable
+	parse     goja.Callable
+	stringify goja.Callable
+}
+
+// NewJSTransform compiles the JavaScript source of a transform and loads it
+// into a first runtime, so that syntax errors and errors in the top level of
+// the transform are reported straight away. Transforms run in a sandbox, and
+// each call is stopped if it exceeds limits.
+func NewJSTransform(name string, source string, limits TransformLimits) (*JSTransform, error) {
+	program, err := goja.Compile(name, source, false)
+	if err != nil {
+		return nil, fmt.Errorf("Syntax error in transform %s: %s", name, err)
+	}
+
+	t := &JSTransform{
+		name:    name,
+		program: program,
+		limits:  limits,
+	}
+
+	st, err := t.newState()
+	if err != nil {
+		return nil, err
+	}
+	_, t.finishes = goja.AssertFunction(st.vm.Get("finish"))
+	t.put(st)
+
+	return t, nil
+}
+
+func (t *JSTransform) Name() string {
+	return t.name
+}
+
+// Finishes reports whether the transform defines a finish function.
+func (t *JSTransform) Finishes() bool {
+	return t.finishes
+}
+
+func (t *JSTransform) newState() (*jsState, error) {
+	ctx := &transformCallContext{transform: t.name}
+	vm := newSandboxRuntime()
+	vm.Set("rugburn", newJSRugburn(vm, ctx))
+
+	err := callWithLimits(t.name, t.limits, jsInterrupt(vm), func() error {
+		_, err := vm.RunProgram(t.program)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load transform %s: %s", t.name, err)
+	}
+
+	transform, ok := goja.AssertFunction(vm.Get("transform"))
+	if !ok {
+		return nil, fmt.Errorf("Transform %s doesn't define a transform function", t.name)
+	}
+	if init, ok := goja.AssertFunction(vm.Get("init")); ok {
+		err = callWithLimits(t.name, t.limits, jsInterrupt(vm), func() error {
+			_, err := init(goja.Undefined())
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to initialize transform %s: %s", t.name, err)
+		}
+	}
+
+	// Records are passed to and from the transform as JSON, so that values
+	// are converted the same way as they are for Lua transforms
+	jsonObject := vm.Get("JSON").ToObject(vm)
+	parse, _ := goja.AssertFunction(jsonObject.Get("parse"))
+	stringify, _ := goja.AssertFunction(jsonObject.Get("stringify"))
+
+	return &jsState{
+		vm:        vm,
+		ctx:       ctx,
+		transform: transform,
+		parse:     parse,
+		stringify: stringify,
+	}, nil
+}
+
+func (t *JSTransform) get() (*jsState, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	n := len(t.pool)
+	if n == 0 {
+		return t.newState()
+	}
+	st := t.pool[n-1]
+	t.pool = t.pool[:n-1]
+	return st, nil
+}
+
+func (t *JSTransform) put(st *jsState) {
+	st.ctx.record = nil
+	st.ctx.page = nil
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.pool = append(t.pool, st)
+}
+
+// Close releases the pooled runtimes.
+func (t *JSTransform) Close() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.pool = nil
+}
+
+// Apply runs the transform function over a record. The function may return
+// an object to replace the record, null or undefined to drop it, or an array
+// of objects to replace it with several records. page may be nil if the
+// record didn't come from a page.
+func (t *JSTransform) Apply(result map[string]interface{}, page *PageContext) ([]map[string]interface{}, error) {
+	j, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := t.get()
+	if err != nil {
+		return nil, err
+	}
+	defer t.put(st)
+	st.ctx.record = result
+	st.ctx.page = page
+
+	var ret string
+	ctx, release := newJSPageContext(st.vm, page)
+	defer release()
+	err = callWithLimits(t.name, t.limits, jsInterrupt(st.vm), func() error {
+		record, err := st.parse(goja.Undefined(), st.vm.ToValue(string(j)))
+		if err != nil {
+			return err
+		}
+		value, err := st.transform(goja.Undefined(), record, ctx)
+		if err != nil {
+			return err
+		}
+		ret, err = jsStringify(st, value)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return jsTransformResults(ret)
+}
+
+// ApplyValue runs the transform function over the value of a single field,
+// and returns the value it returns.
+func (t *JSTransform) ApplyValue(value interface{}) (interface{}, error) {
+	j, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := t.get()
+	if err != nil {
+		return nil, err
+	}
+	defer t.put(st)
+
+	var ret string
+	err = callWithLimits(t.name, t.limits, jsInterrupt(st.vm), func() error {
+		v, err := st.parse(goja.Undefined(), st.vm.ToValue(string(j)))
+		if err != nil {
+			return err
+		}
+		v, err = st.transform(goja.Undefined(), v)
+		if err != nil {
+			return err
+		}
+		ret, err = jsStringify(st, v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result interface{}
+	err = json.Unmarshal([]byte(ret), &result)
+	return result, err
+}
+
+// Finish calls the finish function of the transform, if it has one, and
+// returns the records it returned.
+func (t *JSTransform) Finish() ([]map[string]interface{}, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	var results = []map[string]interface{}{}
+	for _, st := range t.pool {
+		finish, ok := goja.AssertFunction(st.vm.Get("finish"))
+		if !ok {
+			continue
+		}
+
+		var ret string
+		err := callWithLimits(t.name, t.limits, jsInterrupt(st.vm), func() error {
+			value, err := finish(goja.Undefined())
+			if err != nil {
+				return err
+			}
+			ret, err = jsStringify(st, value)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Transform %s failed in finish: %s", t.name, err)
+		}
+
+		finished, err := jsTransformResults(ret)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, finished...)
+	}
+
+	return results, nil
+}
+
+// jsStringify converts a value returned by a transform into JSON. undefined is
+// converted into null.
+func jsStringify(st *jsState, value goja.Value) (string, error) {
+	if goja.IsUndefined(value) || goja.IsNull(value) {
+		return "null", nil
+	}
+	s, err := st.stringify(goja.Undefined(), value)
+	if err != nil {
+		return "", err
+	}
+	if goja.IsUndefined(s) {
+		return "", fmt.Errorf("Transform returned a value which can't be converted to JSON")
+	}
+	return s.String(), nil
+}
+
+func jsTransformResults(ret string) ([]map[string]interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal([]byte(ret), &value)
+	if err != nil {
+		return nil, err
+	}
+	switch value.(type) {
+	case nil, map[string]interface{}, []interface{}:
+		return transformResults(value)
+	}
+	return nil, fmt.Errorf("Unexpected value returned by transform. Should be an object, an array of objects or null.")
+}
+
+// jsInterrupt stops a runtime when ctx is cancelled.
+func jsInterrupt(vm *goja.Runtime) func(ctx context.Context) func() {
+	return func(ctx context.Context) func() {
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-done:
+			case <-ctx.Done():
+				vm.Interrupt(ctx.Err())
+			}
+		}()
+		return func() {
+			close(done)
+			<-stopped
+			vm.ClearInterrupt()
+		}
+	}
+}
+
+// newJSPageContext creates the ctx argument of a transform function. Pages
+// are freed once they have been scraped, so release must be called when the
+// function returns, after which ctx.xpath and ctx.xpathAll throw an error.
+func newJSPageContext(vm *goja.Runtime, page *PageContext) (*goja.Object, func()) {
+	ctx := vm.NewObject()
+	if page == nil {
+		return ctx, func() {}
+	}
+
+	ctx.Set("scraper", page.Scraper)
+	if page.Result != nil {
+		ctx.Set("url", page.Result.URL.String())
+		ctx.Set("status", page.Result.StatusCode)
+		headers := vm.NewObject()
+		for k, v := range page.Result.Header {
+			headers.Set(k, strings.Join(v, ", "))
+		}
+		ctx.Set("headers", headers)
+	}
+
+	var released = false
+	var find = func(expr string) ([]string, error) {
+		if released {
+			return nil, errors.New("ctx.xpath can only be used while the transform is called for the page")
+		}
+		return findText(page.Node, expr)
+	}
+	if page.Node != nil {
+		ctx.Set("xpath", func(expr string) (interface{}, error) {
+			values, err := find(expr)
+			if err != nil || len(values) == 0 {
+				return nil, err
+			}
+			return values[0], nil
+		})
+		ctx.Set("xpathAll", func(expr string) (goja.Value, error) {
+			values, err := find(expr)
+			if err != nil {
+				return nil, err
+			}
+			return jsStringArray(vm, values), nil
+		})
+	}
+
+	return ctx, func() { released = true }
+}
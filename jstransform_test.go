@@ -0,0 +1,280 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	libxml2 "github.com/lestrrat/go-libxml2"
+	"github.com/lestrrat/go-libxml2/xpath"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSTransform(t *testing.T) {
+	transform, err := NewJSTransform("test.js", `
+		function transform(state) {
+			state.foo = state.foo * 2;
+			state.tags.push("c");
+			return state;
+		}
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	result, err := transform.Apply(map[string]interface{}{
+		"foo":  10,
+		"tags": []string{"a", "b"},
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]interface{}{{
+		"foo":  float64(20),
+		"tags": []interface{}{"a", "b", "c"},
+	}}, result)
+}
+
+func TestJSDropAndFanOut(t *testing.T) {
+	transform, err := NewJSTransform("test.js", `
+		function transform(state) {
+			if (state.items.length === 0) {
+				return null;
+			}
+			return state.items;
+		}
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	result, err := transform.Apply(map[string]interface{}{"items": []interface{}{}}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, result, 0)
+
+	result, err = transform.Apply(map[string]interface{}{"items": []interface{}{
+		map[string]interface{}{"n": 1},
+		map[string]interface{}{"n": 2},
+	}}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, result, 2)
+
+	transform, err = NewJSTransform("test.js", `function transform(state) { return "foo"; }`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+	_, err = transform.Apply(map[string]interface{}{}, nil)
+	assert.Error(t, err)
+}
+
+func TestJSInitAndFinish(t *testing.T) {
+	transform, err := NewJSTransform("test.js", `
+		var count;
+		function init() {
+			count = 0;
+		}
+		function transform(state) {
+			count++;
+			return state;
+		}
+		function finish() {
+			return { total: count };
+		}
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+	assert.True(t, transform.Finishes())
+
+	for i := 0; i < 3; i++ {
+		_, err = transform.Apply(map[string]interface{}{}, nil)
+		assert.NoError(t, err)
+	}
+	result, err := transform.Finish()
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]interface{}{{"total": float64(3)}}, result)
+}
+
+func TestJSErrors(t *testing.T) {
+	_, err := NewJSTransform("test.js", "function transform(state) {", TransformLimits{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "test.js")
+
+	_, err = NewJSTransform("test.js", "var x = 1;", TransformLimits{})
+	assert.Error(t, err)
+
+	transform, err := NewJSTransform("test.js", `
+		function transform(state) {
+			throw new Error("boom");
+		}
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	_, err = transform.Apply(map[string]interface{}{}, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "boom")
+	assert.Contains(t, err.Error(), "test.js:3")
+}
+
+func TestJSSandbox(t *testing.T) {
+	for _, source := range []string{
+		`function transform(state) { require("fs"); return state; }`,
+		`function transform(state) { process.exit(1); return state; }`,
+		`function transform(state) { return fetch("http://foo.com"); }`,
+		`function transform(state) { function f() { f(); } f(); }`,
+	} {
+		transform, err := NewJSTransform("test.js", source, TransformLimits{})
+		assert.NoError(t, err)
+
+		_, err = transform.Apply(map[string]interface{}{}, nil)
+		assert.Error(t, err, source)
+		transform.Close()
+	}
+}
+
+func TestJSTimeLimit(t *testing.T) {
+	transform, err := NewJSTransform("test.js", `
+		function transform(state) {
+			while (true) {}
+		}
+	`, TransformLimits{Timeout: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	_, err = transform.Apply(map[string]interface{}{}, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "time limit")
+
+	// The runtime can still be used once it has been interrupted
+	transform, err = NewJSTransform("test.js", `
+		function transform(state) {
+			if (state.loop) {
+				while (true) {}
+			}
+			return state;
+		}
+	`, TransformLimits{Timeout: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	defer transform.Close()
+	_, err = transform.Apply(map[string]interface{}{"loop": true}, nil)
+	assert.Error(t, err)
+	_, err = transform.Apply(map[string]interface{}{"loop": false}, nil)
+	assert.NoError(t, err)
+}
+
+func TestJSRecursionLimit(t *testing.T) {
+	transform, err := NewJSTransform("test.js", `
+		function recurse(n) {
+			return recurse(n + 1) + 1;
+		}
+		function transform(state) {
+			state.n = recurse(0);
+			return state;
+		}
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	_, err = transform.Apply(map[string]interface{}{}, nil)
+	assert.Error(t, err)
+}
+
+func TestJSRugburn(t *testing.T) {
+	transform, err := NewJSTransform("test.js", `
+		function transform(state) {
+			state.sha1 = rugburn.hash.sha1("rugburn");
+			state.host = rugburn.url.parse("http://foo.com/a?b=c").host;
+			state.id = rugburn.url.query("http://foo.com/?id=5").id;
+			state.resolved = rugburn.url.resolve("http://foo.com/a/", "../b");
+			state.text = rugburn.html.stripTags("<b>bold</b> text");
+			state.date = rugburn.time.format("2006-01-02", rugburn.time.parse("2006-01-02", "2017-03-04"));
+			console.log("logged");
+			return state;
+		}
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	result, err := transform.Apply(map[string]interface{}{}, nil)
+	assert.NoError(t, err)
+	r := result[0]
+	assert.Equal(t, "8c4c3ecfd6227e58773741f9531c45b9cacf0527", r["sha1"])
+	assert.Equal(t, "foo.com", r["host"])
+	assert.Equal(t, "5", r["id"])
+	assert.Equal(t, "http://foo.com/b", r["resolved"])
+	assert.Equal(t, "bold text", r["text"])
+	assert.Equal(t, "2017-03-04", r["date"])
+}
+
+func TestJSPageContext(t *testing.T) {
+	transform, err := NewJSTransform("test.js", `
+		function transform(state, ctx) {
+			state.url = ctx.url;
+			state.status = ctx.status;
+			state.type = ctx.headers["Content-Type"];
+			state.scraper = ctx.scraper;
+			state.title = ctx.xpath("./span/text()");
+			state.links = ctx.xpathAll("./a/@href");
+			state.missing = ctx.xpath("./p");
+			return state;
+		}
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	doc, err := libxml2.ParseHTMLString(`<html><body><div><span>title1</span><a href="/a">a</a><a href="/b">b</a></div></body></html>`)
+	assert.NoError(t, err)
+	defer doc.Free()
+
+	ctx, err := xpath.NewContext(doc)
+	assert.NoError(t, err)
+	defer ctx.Free()
+
+	xpResult, err := ctx.Find("//div")
+	assert.NoError(t, err)
+	defer xpResult.Free()
+	nodes := xpResult.NodeList()
+
+	u, _ := url.Parse("http://foo.com")
+	result, err := transform.Apply(map[string]interface{}{}, &PageContext{
+		Scraper: "Test",
+		Result: &SpiderResult{
+			URL:        u,
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": []string{"text/html"}},
+		},
+		Node: nodes[0],
+	})
+	assert.NoError(t, err)
+	r := result[0]
+	assert.Equal(t, "http://foo.com", r["url"])
+	assert.Equal(t, float64(200), r["status"])
+	assert.Equal(t, "text/html", r["type"])
+	assert.Equal(t, "Test", r["scraper"])
+	assert.Equal(t, "title1", r["title"])
+	assert.Equal(t, []interface{}{"/a", "/b"}, r["links"])
+	assert.Nil(t, r["missing"])
+}
+
+func TestJSPageContextReleased(t *testing.T) {
+	transform, err := NewJSTransform("test.js", `
+		var saved = null;
+		function transform(state, ctx) {
+			if (saved !== null) {
+				state.title = saved.xpath("./span/text()");
+			}
+			saved = ctx;
+			return state;
+		}
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	doc, err := libxml2.ParseHTMLString(`<html><body><span>title1</span></body></html>`)
+	assert.NoError(t, err)
+	defer doc.Free()
+
+	_, err = transform.Apply(map[string]interface{}{}, &PageContext{Scraper: "Test", Node: doc})
+	assert.NoError(t, err)
+
+	// The ctx of a page can't read it once the transform has returned
+	_, err = transform.Apply(map[string]interface{}{}, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ctx.xpath can only be used while the transform is called for the page")
+}
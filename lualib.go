@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+	xhtml "golang.org/x/net/html"
+)
+
+// transformCallContext describes what a transform is currently transforming,
+// so that log messages can include it.
+type transformCallContext struct {
+	transform string
+	record    map[string]interface{}
+	page      *PageContext
+}
+
+func (c *transformCallContext) fields() log.Fields {
+	var fields = log.Fields{
+		"transform": c.transform,
+	}
+	if c.page != nil {
+		fields["scraper"] = c.page.Scraper
+		if c.page.Result != nil {
+			fields["url"] = c.page.Result.URL.String()
+		}
+	}
+	if c.record != nil {
+		record, _ := json.Marshal(c.record)
+		fields["record"] = string(record)
+	}
+	return fields
+}
+
+// preloadRugburn makes the rugburn module available to require.
+func preloadRugburn(l *lua.LState, ctx *transformCallContext) {
+	l.PreloadModule("rugburn", func(l *lua.LState) int {
+		mod := l.NewTable()
+		l.SetField(mod, "strings", l.SetFuncs(l.NewTable(), luaStringsFuncs))
+		l.SetField(mod, "re", l.SetFuncs(l.NewTable(), newLuaReFuncs()))
+		l.SetField(mod, "time", l.SetFuncs(l.NewTable(), luaTimeFuncs))
+		l.SetField(mod, "url", l.SetFuncs(l.NewTable(), luaURLFuncs))
+		l.SetField(mod, "hash", l.SetFuncs(l.NewTable(), luaHashFuncs))
+		l.SetField(mod, "html", l.SetFuncs(l.NewTable(), luaHTMLFuncs))
+		l.SetField(mod, "log", l.SetFuncs(l.NewTable(), newLuaLogFuncs(ctx)))
+		l.Push(mod)
+		return 1
+	})
+}
+
+func luaStringArray(l *lua.LState, values []string) *lua.LTable {
+	t := l.CreateTable(len(values), 0)
+	for _, v := range values {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+var luaStringsFuncs = map[string]lua.LGFunction{
+	"trim": func(l *lua.LState) int {
+		s := l.CheckString(1)
+		if l.GetTop() >= 2 {
+			l.Push(lua.LString(strings.Trim(s, l.CheckString(2))))
+			return 1
+		}
+		l.Push(lua.LString(strings.TrimSpace(s)))
+		return 1
+	},
+	"split": func(l *lua.LState) int {
+		l.Push(luaStringArray(l, strings.Split(l.CheckString(1), l.CheckString(2))))
+		return 1
+	},
+}
+
+// maxCachedRegexps is how many compiled regular expressions a Lua state
+// keeps, so that patterns built from page content can't grow it forever.
+const maxCachedRegexps = 100
+
+// regexpCache holds compiled regular expressions by their pattern. It is
+// cleared when it is full, which is cheaper than tracking which were used.
+type regexpCache struct {
+	max     int
+	regexps map[string]*regexp.Regexp
+}
+
+func newRegexpCache(max int) *regexpCache {
+	return &regexpCache{max: max, regexps: map[string]*regexp.Regexp{}}
+}
+
+func (c *regexpCache) compile(pattern string) (*regexp.Regexp, error) {
+	if re, ok := c.regexps[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.regexps) >= c.max {
+		c.regexps = map[string]*regexp.Regexp{}
+	}
+	c.regexps[pattern] = re
+	return re, nil
+}
+
+// newLuaReFuncs returns the regular expression functions, which use Go's
+// regexp syntax. Compiled expressions are cached, up to maxCachedRegexps.
+func newLuaReFuncs() map[string]lua.LGFunction {
+	var cache = newRegexpCache(maxCachedRegexps)
+	compile := func(l *lua.LState) *regexp.Regexp {
+		re, err := cache.compile(l.CheckString(1))
+		if err != nil {
+			l.ArgError(1, err.Error())
+		}
+		return re
+	}
+
+	return map[string]lua.LGFunction{
+		"match": func(l *lua.LState) int {
+			re := compile(l)
+			l.Push(lua.LBool(re.MatchString(l.CheckString(2))))
+			return 1
+		},
+		"find": func(l *lua.LState) int {
+			re := compile(l)
+			m := re.FindStringSubmatch(l.CheckString(2))
+			if m == nil {
+				l.Push(lua.LNil)
+				return 1
+			}
+			// Return the whole match followed by any groups
+			for _, s := range m {
+				l.Push(lua.LString(s))
+			}
+			return len(m)
+		},
+		"findAll": func(l *lua.LState) int {
+			re := compile(l)
+			l.Push(luaStringArray(l, re.FindAllString(l.CheckString(2), l.OptInt(3, -1))))
+			return 1
+		},
+		"replace": func(l *lua.LState) int {
+			re := compile(l)
+			l.Push(lua.LString(re.ReplaceAllString(l.CheckString(2), l.CheckString(3))))
+			return 1
+		},
+		"split": func(l *lua.LState) int {
+			re := compile(l)
+			l.Push(luaStringArray(l, re.Split(l.CheckString(2), l.OptInt(3, -1))))
+			return 1
+		},
+	}
+}
+
+// Times are passed to and from Lua as Unix timestamps in seconds, like
+// os.time, and use Go's time layouts.
+var luaTimeFuncs = map[string]lua.LGFunction{
+	"parse": func(l *lua.LState) int {
+		t, err := time.Parse(l.CheckString(1), l.CheckString(2))
+		if err != nil {
+			l.Push(lua.LNil)
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
+		l.Push(lua.LNumber(float64(t.UnixNano()) / float64(time.Second)))
+		return 1
+	},
+	"format": func(l *lua.LState) int {
+		seconds := float64(l.CheckNumber(2))
+		t := time.Unix(0, int64(seconds*float64(time.Second))).UTC()
+		l.Push(lua.LString(t.Format(l.CheckString(1))))
+		return 1
+	},
+	"now": func(l *lua.LState) int {
+		l.Push(lua.LNumber(float64(time.Now().UnixNano()) / float64(time.Second)))
+		return 1
+	},
+}
+
+func luaQuery(l *lua.LState, values url.Values) *lua.LTable {
+	t := l.NewTable()
+	for k, v := range values {
+		if len(v) == 1 {
+			t.RawSetString(k, lua.LString(v[0]))
+			continue
+		}
+		t.RawSetString(k, luaStringArray(l, v))
+	}
+	return t
+}
+
+var luaURLFuncs = map[string]lua.LGFunction{
+	"parse": func(l *lua.LState) int {
+		u, err := url.Parse(l.CheckString(1))
+		if err != nil {
+			l.Push(lua.LNil)
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
+		t := l.NewTable()
+		t.RawSetString("scheme", lua.LString(u.Scheme))
+		t.RawSetString("host", lua.LString(u.Hostname()))
+		t.RawSetString("port", lua.LString(u.Port()))
+		t.RawSetString("path", lua.LString(u.Path))
+		t.RawSetString("rawQuery", lua.LString(u.RawQuery))
+		t.RawSetString("query", luaQuery(l, u.Query()))
+		t.RawSetString("fragment", lua.LString(u.Fragment))
+		l.Push(t)
+		return 1
+	},
+	"resolve": func(l *lua.LState) int {
+		base, err := url.Parse(l.CheckString(1))
+		if err != nil {
+			l.ArgError(1, err.Error())
+		}
+		ref, err := url.Parse(l.CheckString(2))
+		if err != nil {
+			l.ArgError(2, err.Error())
+		}
+		l.Push(lua.LString(base.ResolveReference(ref).String()))
+		return 1
+	},
+	"query": func(l *lua.LState) int {
+		s := l.CheckString(1)
+		if i := strings.Index(s, "?"); i >= 0 {
+			s = s[i+1:]
+		}
+		values, err := url.ParseQuery(s)
+		if err != nil {
+			l.Push(lua.LNil)
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
+		l.Push(luaQuery(l, values))
+		return 1
+	},
+}
+
+func luaHashFunc(newHash func() hash.Hash) lua.LGFunction {
+	return func(l *lua.LState) int {
+		h := newHash()
+		h.Write([]byte(l.CheckString(1)))
+		l.Push(lua.LString(hex.EncodeToString(h.Sum(nil))))
+		return 1
+	}
+}
+
+var luaHashFuncs = map[string]lua.LGFunction{
+	"sha1": luaHashFunc(sha1.New),
+	"md5":  luaHashFunc(md5.New),
+}
+
+var luaHTMLFuncs = map[string]lua.LGFunction{
+	"unescape": func(l *lua.LState) int {
+		l.Push(lua.LString(html.UnescapeString(l.CheckString(1))))
+		return 1
+	},
+	"stripTags": func(l *lua.LState) int {
+		l.Push(lua.LString(stripTags(l.CheckString(1))))
+		return 1
+	},
+}
+
+// stripTags returns the text of an HTML fragment.
+func stripTags(s string) string {
+	var buffer = bytes.NewBuffer([]byte{})
+	z := xhtml.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			break
+		}
+		if tt == xhtml.TextToken {
+			buffer.Write(z.Text())
+		}
+	}
+	return buffer.String()
+}
+
+func newLuaLogFuncs(ctx *transformCallContext) map[string]lua.LGFunction {
+	logFunc := func(fn func(entry *log.Entry, args ...interface{})) lua.LGFunction {
+		return func(l *lua.LState) int {
+			fn(log.WithFields(ctx.fields()), l.CheckString(1))
+			return 0
+		}
+	}
+	return map[string]lua.LGFunction{
+		"debug": logFunc((*log.Entry).Debug),
+		"info":  logFunc((*log.Entry).Info),
+		"warn":  logFunc((*log.Entry).Warn),
+		"error": logFunc((*log.Entry).Error),
+	}
+}
@@ -1,30 +1,50 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
 func main() {
+	// Scraper output may go to stdout, so keep logs out of it
+	log.SetOutput(os.Stderr)
+
+	// Keep values interpolated from the environment out of the logs
+	log.SetFormatter(&redactFormatter{log.StandardLogger().Formatter})
+
+	// Keep log lines from being written into the progress of the spider
+	log.AddHook(progressLine)
+
+	// Report writes to a closed pipe as EPIPE errors rather than being killed,
+	// so that outputs are flushed and closed cleanly
+	signal.Ignore(syscall.SIGPIPE)
+
 	app := cli.NewApp()
 	curDir := filepath.Dir(os.Args[0])
 
 	var flagVerbose bool
 	var flagRunScrapers bool
 	var flagRunSpider bool
+	var flagFull bool
+	var flagScraper string
+	var flagSpider string
+	var flagShutdownTimeout time.Duration
 	var flagRugPath string
+	var flagFormat string
 
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:        "config",
-			Value:       "rug.json",
-			Usage:       "The path to the rug.json",
+			Usage:       "The path to the config. Defaults to rug.json, rug.yaml, rug.yml or rug.toml, whichever exists",
 			Destination: &flagRugPath,
 		},
 		cli.BoolFlag{
@@ -37,26 +57,52 @@ func main() {
 	app.Name = "rugburn"
 	app.Usage = "A configuration-based web scraper"
 
+	app.Before = func(c *cli.Context) error {
+		if flagRugPath == "" {
+			flagRugPath = findRugFile()
+		}
+		return nil
+	}
+
 	app.Commands = []cli.Command{
 		{
 			Name:  "init",
 			Usage: "Initialize a new rugburn project in this directory",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "format",
+					Value:       formatJSON,
+					Usage:       "The format of the config: json, yaml or toml",
+					Destination: &flagFormat,
+				},
+			},
 			Action: func(c *cli.Context) error {
-				if _, err := os.Stat(fmt.Sprintf("%s/%s", curDir, flagRugPath)); !os.IsNotExist(err) {
-					fmt.Println("A rugburn project already exists in this directory")
-					os.Exit(1)
+				for _, name := range rugFileNames {
+					if _, err := os.Stat(fmt.Sprintf("%s/%s", curDir, name)); !os.IsNotExist(err) {
+						fmt.Println("A rugburn project already exists in this directory")
+						os.Exit(1)
+					}
 				}
+
+				switch flagFormat {
+				case formatJSON, formatYAML, formatTOML:
+				case "yml":
+					flagFormat = formatYAML
+				default:
+					return fmt.Errorf("Unknown config format \"%s\"", flagFormat)
+				}
+
 				err := os.Mkdir("transforms", 0700)
 				if err != nil {
 					return err
 				}
 
 				// Create example rugfile
-				f, err := os.Create("./rug.json")
+				f, err := os.Create("./rug." + flagFormat)
 				if err != nil {
 					return err
 				}
-				d, err := Asset("bindata/rug.json")
+				d, err := Asset("bindata/rug." + flagFormat)
 				if err != nil {
 					return err
 				}
@@ -97,15 +143,36 @@ func main() {
 			Usage: "Run the rugburn project in this directory",
 			Flags: []cli.Flag{
 				cli.BoolFlag{
-					Name:        "spider",
-					Usage:       "Runs the spider only",
+					Name:        "spiders",
+					Usage:       "Run the spiders only",
 					Destination: &flagRunSpider,
 				},
+				cli.StringFlag{
+					Name:        "spider",
+					Usage:       "Run only the spider with this name",
+					Destination: &flagSpider,
+				},
 				cli.BoolFlag{
 					Name:        "scrapers",
 					Usage:       "Run the scrapers only",
 					Destination: &flagRunScrapers,
 				},
+				cli.BoolFlag{
+					Name:        "full",
+					Usage:       "Truncate scraper outputs and scrape every page again",
+					Destination: &flagFull,
+				},
+				cli.StringFlag{
+					Name:        "scraper",
+					Usage:       "Run only the scraper with this name",
+					Destination: &flagScraper,
+				},
+				cli.DurationFlag{
+					Name:        "shutdown-timeout",
+					Value:       defaultShutdownTimeout,
+					Usage:       "How long to wait for requests in flight when stopped by Ctrl-C",
+					Destination: &flagShutdownTimeout,
+				},
 			},
 			Action: func(c *cli.Context) error {
 				if flagVerbose {
@@ -113,20 +180,20 @@ func main() {
 					log.Debug("Verbose logging enabled.")
 				}
 
+				if flagScraper != "" {
+					flagRunScrapers = true
+				}
+				if flagSpider != "" {
+					flagRunSpider = true
+				}
+
 				if !flagRunSpider && !flagRunScrapers {
 					flagRunSpider = true
 					flagRunScrapers = true
 				}
 
-				fileData, err := ioutil.ReadFile(flagRugPath)
+				rugFile, err := loadRugFile(flagRugPath)
 				if err != nil {
-					log.Errorf("Can't find rugburn config in %s", flagRugPath)
-					return err
-				}
-				rugFile := &RugFile{}
-				err = json.Unmarshal(fileData, rugFile)
-				if err != nil {
-					log.Errorf("Invalid JSON in %s", flagRugPath)
 					return err
 				}
 
@@ -134,10 +201,27 @@ func main() {
 				if err != nil {
 					return err
 				}
+				defer store.Close()
+
+				stop := stopOnSignal()
+				go func() {
+					<-stop
+					if rugFile.Options.StoreOptions.Strategy == strategyMem {
+						log.Warn("The memory store is lost when rugburn exits, use the disk strategy to resume crawls")
+					}
+				}()
 
 				if flagRunSpider {
 					log.Info("Starting spider..")
-					err = RunSpider(store, rugFile)
+					err = RunSpider(store, rugFile, CrawlOptions{
+						Spider:          flagSpider,
+						Stop:            stop,
+						ShutdownTimeout: flagShutdownTimeout,
+					})
+					if err == errStopped {
+						log.Info("Stopped. Run \"rugburn run\" again to resume the crawl.")
+						return err
+					}
 					if err != nil {
 						return err
 					}
@@ -145,7 +229,20 @@ func main() {
 
 				if flagRunScrapers {
 					log.Info("Starting scrapers..")
-					err = RunScraper(store, rugFile)
+					err = RunScraper(store, rugFile, ScrapeOptions{
+						Full:    flagFull,
+						Scraper: flagScraper,
+						Stop:    stop,
+					})
+					if err == errStopped {
+						log.Info("Stopped. Run \"rugburn run\" again to scrape the remaining pages.")
+						return err
+					}
+					if isBrokenPipe(err) {
+						// Whoever was reading our output has gone away
+						log.Debug("Output closed, stopping scrapers.")
+						return nil
+					}
 					if err != nil {
 						return err
 					}
@@ -154,6 +251,30 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "validate",
+			Usage: "Check the rugburn config in this directory for problems",
+			Action: func(c *cli.Context) error {
+				_, err := loadRugFile(flagRugPath)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s is valid\n", flagRugPath)
+				return nil
+			},
+		},
+		{
+			Name:  "schema",
+			Usage: "Print the JSON Schema of rug.json",
+			Action: func(c *cli.Context) error {
+				j, err := configSchemaJSON()
+				if err != nil {
+					return err
+				}
+				_, err = os.Stdout.Write(j)
+				return err
+			},
+		},
 		{
 			Name:  "clean",
 			Usage: "Cleans the cached data from the current rugburn project",
@@ -177,17 +298,54 @@ func main() {
 		return nil
 	}
 
-	app.RunAndExitOnError()
+	err := app.Run(spiderFlagArgs(os.Args))
+	if err == errStopped {
+		os.Exit(130)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, secrets.Redact(err.Error()))
+		os.Exit(1)
+	}
+}
+
+// spiderFlagArgs rewrites a --spider without a name, which ran the spider only
+// before spiders were named, into --spiders.
+func spiderFlagArgs(args []string) []string {
+	var rewritten = append([]string{}, args...)
+	for i, arg := range rewritten {
+		if arg == "--" {
+			break
+		}
+		if arg != "--spider" && arg != "-spider" {
+			continue
+		}
+		if i+1 == len(rewritten) || strings.HasPrefix(rewritten[i+1], "-") {
+			log.Warn("--spider without a name is deprecated, use --spiders to run the spiders only")
+			rewritten[i] = "--spiders"
+		}
+	}
+	return rewritten
+}
+
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE)
 }
 
 type ConfigOptions struct {
-	SpiderOptions *ConfigSpiderOptions `json:"spiders"`
-	StoreOptions  *ConfigStoreOptions  `json:"store"`
+	SpiderOptions    *ConfigSpiderOptions    `json:"spiders"`
+	StoreOptions     *ConfigStoreOptions     `json:"store"`
+	TransformOptions *ConfigTransformOptions `json:"transforms"`
 }
 
 type ConfigSpiderOptions struct {
-	Concurrency int `json:"concurrency"`
-	MaxResults  int `json:"max"`
+	Concurrency int    `json:"concurrency"`
+	MaxResults  int    `json:"max"`
+	Order       string `json:"order"`
+}
+
+type ConfigTransformOptions struct {
+	Timeout   int `json:"timeout"`
+	MaxMemory int `json:"maxMemory"`
 }
 
 type ConfigStoreOptions struct {
@@ -195,23 +353,100 @@ type ConfigStoreOptions struct {
 }
 
 type ConfigScraper struct {
-	Name       string                 `json:"name"`
-	Output     string                 `json:"output"`
-	Test       string                 `json:"test"`
-	Context    string                 `json:"context"`
-	Fields     map[string]interface{} `json:"fields"`
-	Transforms []string               `json:"transforms"`
+	Name             string                 `json:"name"`
+	Output           *ConfigOutput          `json:"output"`
+	Test             string                 `json:"test"`
+	Context          string                 `json:"context"`
+	Fields           map[string]interface{} `json:"fields"`
+	Transforms       []*ConfigTransform     `json:"transforms"`
+	Key              []string               `json:"key"`
+	Dedupe           string                 `json:"dedupe"`
+	OnTransformError string                 `json:"onTransformError"`
+	Extends          string                 `json:"extends"`
+	Spiders          []string               `json:"spiders"`
+}
+
+type ConfigTransform struct {
+	Path   string            `json:"path"`
+	Lua    string            `json:"lua"`
+	JS     string            `json:"js"`
+	Set    map[string]string `json:"set"`
+	Rename map[string]string `json:"rename"`
+	Drop   []string          `json:"drop"`
+	Where  string            `json:"where"`
+}
+
+type ConfigOutput struct {
+	Type    string   `json:"type"`
+	Path    string   `json:"path"`
+	Columns []string `json:"columns"`
+	Table   string   `json:"table"`
+	Key     []string `json:"key"`
+}
+
+// ConfigSpiderOverrides are the options of a single spider. Options which
+// are set override those in ConfigSpiderOptions.
+type ConfigSpiderOverrides struct {
+	Concurrency *int   `json:"concurrency"`
+	MaxResults  *int   `json:"max"`
+	Order       string `json:"order"`
 }
 
 type ConfigSpider struct {
-	URLs       []string `json:"urls"`
-	TestXPATH  string   `json:"test"`
-	LinksXPATH []string `json:"links"`
+	Name      string                 `json:"name"`
+	URLs      []string               `json:"urls"`
+	TestXPATH string                 `json:"test"`
+	Links     []*ConfigLinkRule      `json:"links"`
+	Options   *ConfigSpiderOverrides `json:"options"`
+}
+
+// ConfigLinkRule selects links for a spider to follow. A rule given as a
+// string is just its XPath.
+type ConfigLinkRule struct {
+	Name     string   `json:"name"`
+	XPath    string   `json:"xpath"`
+	Follow   *bool    `json:"follow"`
+	MaxDepth int      `json:"maxDepth"`
+	Priority int      `json:"priority"`
+	Include  []string `json:"include"`
+	Exclude  []string `json:"exclude"`
+}
+
+// options returns the options of the spider, with its overrides applied.
+func (s *ConfigSpider) options(defaults *ConfigSpiderOptions) *ConfigSpiderOptions {
+	var options = &ConfigSpiderOptions{}
+	if defaults != nil {
+		*options = *defaults
+	}
+	if s.Options != nil {
+		if s.Options.Concurrency != nil {
+			options.Concurrency = *s.Options.Concurrency
+		}
+		if s.Options.MaxResults != nil {
+			options.MaxResults = *s.Options.MaxResults
+		}
+		if s.Options.Order != "" {
+			options.Order = s.Options.Order
+		}
+	}
+	return options
 }
 
 type RugFile struct {
-	Name     string           `json:"name"`
-	Options  *ConfigOptions   `json:"options"`
-	Spider   *ConfigSpider    `json:"spider"`
-	Scrapers []*ConfigScraper `json:"scrapers"`
+	Schema    string                            `json:"$schema"`
+	Include   []string                          `json:"include"`
+	Name      string                            `json:"name"`
+	Options   *ConfigOptions                    `json:"options"`
+	Spider    *ConfigSpider                     `json:"spider"`
+	Spiders   []*ConfigSpider                   `json:"spiders"`
+	FieldSets map[string]map[string]interface{} `json:"fieldSets"`
+	Scrapers  []*ConfigScraper                  `json:"scrapers"`
+}
+
+// allSpiders returns the spider, or the named spiders if there are several.
+func (rugFile *RugFile) allSpiders() []*ConfigSpider {
+	if rugFile.Spider != nil {
+		return []*ConfigSpider{rugFile.Spider}
+	}
+	return rugFile.Spiders
 }
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const outputJSONL = "jsonl"
+const outputCSV = "csv"
+const outputSQLite = "sqlite"
+const outputParquet = "parquet"
+
+// outputStdout is the output path which selects standard output
+const outputStdout = "-"
+
+// OutputSink receives the records produced by a scraper. Close must be called
+// once the scraper is finished in order to flush any buffered records.
+type OutputSink interface {
+	Write(record map[string]interface{}) error
+	Close() error
+}
+
+// outputFlusher is implemented by sinks which can make the records written so
+// far durable before they are closed. The pages of a scraper whose sink isn't
+// one are only marked as scraped once it is closed.
+type outputFlusher interface {
+	Flush() error
+}
+
+// UnmarshalJSON accepts either a plain file path, which is written as JSON
+// lines, or an object selecting the output type.
+func (c *ConfigOutput) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		c.Type = outputJSONL
+		c.Path = path
+		return nil
+	}
+
+	type configOutput ConfigOutput
+	return json.Unmarshal(data, (*configOutput)(c))
+}
+
+// openOutput opens the sink described by config. If truncate is set, any
+// records written by previous runs are removed.
+func openOutput(config *ConfigOutput, truncate bool) (OutputSink, error) {
+	if config == nil || config.Path == "" {
+		return nil, errors.New("Scraper output requires a path")
+	}
+
+	switch config.Type {
+	case outputJSONL, "":
+		return openJSONLOutput(config, truncate)
+	case outputCSV:
+		return openCSVOutput(config, truncate)
+	case outputSQLite:
+		return openSQLiteOutput(config, truncate)
+	case outputParquet:
+		return openParquetOutput(config, truncate)
+	default:
+		return nil, fmt.Errorf("Unknown output type \"%s\"", config.Type)
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func openOutputFile(path string, truncate bool) (io.WriteCloser, error) {
+	if path == outputStdout {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	var flags = os.O_CREATE | os.O_APPEND | os.O_WRONLY
+	if truncate {
+		flags = os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	}
+	return os.OpenFile(path, flags, 0600)
+}
+
+// formatValue converts a record value into a single column value. Strings are
+// kept as they are, anything else is encoded as JSON.
+func formatValue(v interface{}) (string, error) {
+	switch value := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	default:
+		b, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
+
+type jsonlOutput struct {
+	f io.WriteCloser
+}
+
+func openJSONLOutput(config *ConfigOutput, truncate bool) (OutputSink, error) {
+	f, err := openOutputFile(config.Path, truncate)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlOutput{f: f}, nil
+}
+
+func (o *jsonlOutput) Write(record map[string]interface{}) error {
+	j, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = o.f.Write(append(j, '\n'))
+	return err
+}
+
+// Flush does nothing, as records are written to the file as they come.
+func (o *jsonlOutput) Flush() error {
+	return nil
+}
+
+func (o *jsonlOutput) Close() error {
+	return o.f.Close()
+}
+
+type csvOutput struct {
+	f       io.WriteCloser
+	w       *csv.Writer
+	columns []string
+}
+
+func openCSVOutput(config *ConfigOutput, truncate bool) (OutputSink, error) {
+	if len(config.Columns) == 0 {
+		return nil, fmt.Errorf("CSV output %s requires columns", config.Path)
+	}
+
+	f, err := openOutputFile(config.Path, truncate)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &csvOutput{
+		f:       f,
+		w:       csv.NewWriter(f),
+		columns: config.Columns,
+	}
+
+	// Only write the header when starting a new file. Standard output and
+	// pipes always get one.
+	var header = true
+	if file, ok := f.(*os.File); ok {
+		info, err := file.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		header = !info.Mode().IsRegular() || info.Size() == 0
+	}
+
+	if header {
+		err = o.w.Write(config.Columns)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return o, nil
+}
+
+func (o *csvOutput) Write(record map[string]interface{}) error {
+	var row = make([]string, len(o.columns))
+	for i, c := range o.columns {
+		v, err := formatValue(record[c])
+		if err != nil {
+			return err
+		}
+		row[i] = v
+	}
+	return o.w.Write(row)
+}
+
+func (o *csvOutput) Flush() error {
+	o.w.Flush()
+	return o.w.Error()
+}
+
+func (o *csvOutput) Close() error {
+	o.w.Flush()
+	if err := o.w.Error(); err != nil {
+		o.f.Close()
+		return err
+	}
+	return o.f.Close()
+}
+
+type sqliteOutput struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	stmt    *sql.Stmt
+	insert  string
+	columns []string
+}
+
+func quoteIdentifier(name string) string {
+	return "\"" + strings.Replace(name, "\"", "\"\"", -1) + "\""
+}
+
+func openSQLiteOutput(config *ConfigOutput, truncate bool) (OutputSink, error) {
+	if config.Path == outputStdout {
+		return nil, errors.New("SQLite output can't be written to stdout")
+	}
+	if config.Table == "" {
+		return nil, fmt.Errorf("SQLite output %s requires a table", config.Path)
+	}
+	if len(config.Columns) == 0 {
+		return nil, fmt.Errorf("SQLite output %s requires columns", config.Path)
+	}
+
+	var columns = []string{}
+	var params = []string{}
+	var updates = []string{}
+	var hasColumn = map[string]bool{}
+	for _, c := range config.Columns {
+		columns = append(columns, quoteIdentifier(c))
+		params = append(params, "?")
+		updates = append(updates, quoteIdentifier(c)+" = excluded."+quoteIdentifier(c))
+		hasColumn[c] = true
+	}
+
+	var keys = []string{}
+	for _, k := range config.Key {
+		if !hasColumn[k] {
+			return nil, fmt.Errorf("SQLite output key \"%s\" is not one of the columns", k)
+		}
+		keys = append(keys, quoteIdentifier(k))
+	}
+
+	table := quoteIdentifier(config.Table)
+	var statements = []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s TEXT)", table, strings.Join(columns, " TEXT, ")),
+	}
+	if len(keys) > 0 {
+		statements = append(statements, fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s)",
+			quoteIdentifier(config.Table+"_key"), table, strings.Join(keys, ", ")))
+	}
+	if truncate {
+		statements = append(statements, fmt.Sprintf("DELETE FROM %s", table))
+	}
+
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), strings.Join(params, ", "))
+	if len(keys) > 0 {
+		insert += fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(keys, ", "), strings.Join(updates, ", "))
+	}
+
+	db, err := sql.Open("sqlite3", config.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range statements {
+		_, err = db.Exec(s)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	stmt, err := tx.Prepare(insert)
+	if err != nil {
+		tx.Rollback()
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteOutput{
+		db:      db,
+		tx:      tx,
+		stmt:    stmt,
+		insert:  insert,
+		columns: config.Columns,
+	}, nil
+}
+
+func (o *sqliteOutput) Write(record map[string]interface{}) error {
+	var values = make([]interface{}, len(o.columns))
+	for i, c := range o.columns {
+		if record[c] == nil {
+			continue
+		}
+		v, err := formatValue(record[c])
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+	_, err := o.stmt.Exec(values...)
+	return err
+}
+
+// Flush commits the records written so far, and starts a new transaction.
+func (o *sqliteOutput) Flush() error {
+	o.stmt.Close()
+	err := o.tx.Commit()
+	if err != nil {
+		return err
+	}
+	o.tx, err = o.db.Begin()
+	if err != nil {
+		return err
+	}
+	o.stmt, err = o.tx.Prepare(o.insert)
+	return err
+}
+
+func (o *sqliteOutput) Close() error {
+	o.stmt.Close()
+	if err := o.tx.Commit(); err != nil {
+		o.db.Close()
+		return err
+	}
+	return o.db.Close()
+}
+
+// parquetOutput writes to a directory of parquet files. Parquet files can't be
+// appended to, so each run adds a new part file, and truncating removes the
+// parts written by previous runs.
+type parquetOutput struct {
+	dir     string
+	schema  string
+	columns []string
+	fw      source.ParquetFile
+	pw      *writer.JSONWriter
+}
+
+// parquetColumnPattern matches the column names which can be written into a
+// parquet-go schema tag, which is split on commas and equals signs.
+var parquetColumnPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func openParquetOutput(config *ConfigOutput, truncate bool) (OutputSink, error) {
+	if config.Path == outputStdout {
+		return nil, errors.New("Parquet output can't be written to stdout")
+	}
+	if len(config.Columns) == 0 {
+		return nil, fmt.Errorf("Parquet output %s requires columns", config.Path)
+	}
+	for _, c := range config.Columns {
+		if !parquetColumnPattern.MatchString(c) {
+			return nil, fmt.Errorf("Parquet output column \"%s\" should only contain letters, digits and _", c)
+		}
+	}
+
+	err := os.MkdirAll(config.Path, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	if truncate {
+		parts, err := filepath.Glob(filepath.Join(config.Path, "*.parquet"))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range parts {
+			err = os.Remove(p)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var fields = []string{}
+	for _, c := range config.Columns {
+		fields = append(fields, fmt.Sprintf(`{"Tag": "name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"}`, c))
+	}
+
+	return &parquetOutput{
+		dir:     config.Path,
+		schema:  fmt.Sprintf(`{"Tag": "name=parquet_go_root, repetitiontype=REQUIRED", "Fields": [%s]}`, strings.Join(fields, ", ")),
+		columns: config.Columns,
+	}, nil
+}
+
+func (o *parquetOutput) Write(record map[string]interface{}) error {
+	// The part file is created lazily so that runs without new records
+	// don't leave empty files behind.
+	if o.pw == nil {
+		path := filepath.Join(o.dir, fmt.Sprintf("part-%d.parquet", time.Now().UnixNano()))
+		fw, err := local.NewLocalFileWriter(path)
+		if err != nil {
+			return err
+		}
+		pw, err := writer.NewJSONWriter(o.schema, fw, 1)
+		if err != nil {
+			fw.Close()
+			return err
+		}
+		o.fw = fw
+		o.pw = pw
+	}
+
+	var row = make(map[string]string)
+	for _, c := range o.columns {
+		if record[c] == nil {
+			continue
+		}
+		v, err := formatValue(record[c])
+		if err != nil {
+			return err
+		}
+		row[c] = v
+	}
+
+	j, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+
+	return o.pw.Write(string(j))
+}
+
+func (o *parquetOutput) Close() error {
+	if o.pw == nil {
+		return nil
+	}
+	if err := o.pw.WriteStop(); err != nil {
+		o.fw.Close()
+		return err
+	}
+	return o.fw.Close()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestConfigOutputUnmarshal(t *testing.T) {
+	var c = &ConfigScraper{}
+	err := json.Unmarshal([]byte(`{"output": "links.jsonl"}`), c)
+	assert.NoError(t, err)
+	assert.Equal(t, outputJSONL, c.Output.Type)
+	assert.Equal(t, "links.jsonl", c.Output.Path)
+
+	c = &ConfigScraper{}
+	err = json.Unmarshal([]byte(`{"output": {"type": "csv", "path": "links.csv", "columns": ["title"]}}`), c)
+	assert.NoError(t, err)
+	assert.Equal(t, outputCSV, c.Output.Type)
+	assert.Equal(t, "links.csv", c.Output.Path)
+	assert.Equal(t, []string{"title"}, c.Output.Columns)
+}
+
+func TestCSVOutput(t *testing.T) {
+	config := &ConfigOutput{
+		Type:    outputCSV,
+		Path:    "test.csv",
+		Columns: []string{"title", "tags"},
+	}
+
+	defer os.Remove("test.csv")
+
+	for i := 0; i < 2; i++ {
+		o, err := openOutput(config, false)
+		assert.NoError(t, err)
+		err = o.Write(map[string]interface{}{
+			"title": "title1",
+			"tags":  []string{"a", "b"},
+			"other": "ignored",
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, o.Close())
+	}
+
+	b, _ := ioutil.ReadFile("test.csv")
+	assert.Equal(t, "title,tags\ntitle1,\"[\"\"a\"\",\"\"b\"\"]\"\ntitle1,\"[\"\"a\"\",\"\"b\"\"]\"\n", string(b))
+}
+
+func TestSQLiteOutputUpsert(t *testing.T) {
+	config := &ConfigOutput{
+		Type:    outputSQLite,
+		Path:    "test.sqlite",
+		Table:   "links",
+		Columns: []string{"url", "title"},
+		Key:     []string{"url"},
+	}
+
+	defer os.Remove("test.sqlite")
+
+	o, err := openOutput(config, false)
+	assert.NoError(t, err)
+	assert.NoError(t, o.Write(map[string]interface{}{"url": "foo.com", "title": "title1"}))
+	assert.NoError(t, o.Write(map[string]interface{}{"url": "bar.com", "title": "title2"}))
+	assert.NoError(t, o.Write(map[string]interface{}{"url": "foo.com", "title": "title3"}))
+	assert.NoError(t, o.Close())
+
+	db, err := sql.Open("sqlite3", "test.sqlite")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM links`).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	var title string
+	err = db.QueryRow(`SELECT title FROM links WHERE url = ?`, "foo.com").Scan(&title)
+	assert.NoError(t, err)
+	assert.Equal(t, "title3", title)
+}
+
+func TestSQLiteOutputIdentifiers(t *testing.T) {
+	config := &ConfigOutput{
+		Type:    outputSQLite,
+		Path:    "test_identifiers.sqlite",
+		Table:   "order",
+		Columns: []string{"group", "page url", `a "quoted", b=c`},
+		Key:     []string{"group"},
+	}
+
+	defer os.Remove("test_identifiers.sqlite")
+
+	// Table and column names are quoted, so reserved words and punctuation
+	// are written as they are
+	o, err := openOutput(config, false)
+	assert.NoError(t, err)
+	assert.NoError(t, o.Write(map[string]interface{}{"group": "a", "page url": "foo.com", `a "quoted", b=c`: "x"}))
+	assert.NoError(t, o.Close())
+
+	db, err := sql.Open("sqlite3", "test_identifiers.sqlite")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	var url string
+	err = db.QueryRow(`SELECT "page url" FROM "order" WHERE "group" = ?`, "a").Scan(&url)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo.com", url)
+}
+
+func TestSQLiteOutputFlush(t *testing.T) {
+	config := &ConfigOutput{
+		Type:    outputSQLite,
+		Path:    "test_flush.sqlite",
+		Table:   "links",
+		Columns: []string{"url"},
+	}
+
+	defer os.Remove("test_flush.sqlite")
+
+	o, err := openOutput(config, false)
+	assert.NoError(t, err)
+	assert.NoError(t, o.Write(map[string]interface{}{"url": "foo.com"}))
+	assert.NoError(t, o.(outputFlusher).Flush())
+	assert.NoError(t, o.Write(map[string]interface{}{"url": "bar.com"}))
+
+	// Records are committed when the output is flushed, before it is closed
+	db, err := sql.Open("sqlite3", "test_flush.sqlite")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM links`).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.NoError(t, o.Close())
+	err = db.QueryRow(`SELECT COUNT(*) FROM links`).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestParquetOutput(t *testing.T) {
+	config := &ConfigOutput{
+		Type:    outputParquet,
+		Path:    "test_parquet",
+		Columns: []string{"title"},
+	}
+
+	defer os.RemoveAll("test_parquet")
+
+	o, err := openOutput(config, true)
+	assert.NoError(t, err)
+	assert.NoError(t, o.Write(map[string]interface{}{"title": "title1"}))
+	assert.NoError(t, o.Write(map[string]interface{}{"title": "title2"}))
+	assert.NoError(t, o.Close())
+
+	parts, _ := filepath.Glob("test_parquet/*.parquet")
+	assert.Equal(t, 1, len(parts))
+
+	fr, err := local.NewLocalFileReader(parts[0])
+	assert.NoError(t, err)
+	defer fr.Close()
+
+	pr, err := reader.NewParquetReader(fr, nil, 1)
+	assert.NoError(t, err)
+	defer pr.ReadStop()
+	assert.Equal(t, int64(2), pr.GetNumRows())
+
+	// A truncating run without records removes the previous parts
+	o, err = openOutput(config, true)
+	assert.NoError(t, err)
+	assert.NoError(t, o.Close())
+
+	parts, _ = filepath.Glob("test_parquet/*.parquet")
+	assert.Equal(t, 0, len(parts))
+
+	config.Columns = []string{"page url"}
+	_, err = openOutput(config, true)
+	assert.EqualError(t, err, "Parquet output column \"page url\" should only contain letters, digits and _")
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// progressInterval is how often the progress of the spider is drawn when
+// stderr is a terminal.
+const progressInterval = 500 * time.Millisecond
+
+// progressLogInterval is how often the progress of the spider is logged when
+// stderr isn't a terminal.
+const progressLogInterval = 10 * time.Second
+
+// terminalLine is a line at the bottom of the terminal which is drawn over as
+// it changes. It is a logrus hook which clears the line before each log
+// entry, so that log lines aren't written into it, and the next Draw puts it
+// back below them.
+type terminalLine struct {
+	mu    sync.Mutex
+	out   io.Writer
+	drawn bool
+}
+
+var progressLine = &terminalLine{out: os.Stderr}
+
+func (l *terminalLine) Draw(text string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.out, "\r\x1b[K%s", text)
+	l.drawn = true
+}
+
+func (l *terminalLine) Clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.drawn {
+		return
+	}
+	fmt.Fprint(l.out, "\r\x1b[K")
+	l.drawn = false
+}
+
+func (l *terminalLine) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (l *terminalLine) Fire(entry *log.Entry) error {
+	l.Clear()
+	return nil
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// crawlProgress follows the spiders of a run. The progress of the spider
+// running is drawn on the terminal, or logged every progressLogInterval when
+// stderr isn't one, and the run is summed up at the end.
+type crawlProgress struct {
+	terminal bool
+	start    time.Time
+	lastLog  time.Time
+
+	// The spider running, when it started and how many pages it has fetched
+	// since
+	spider   string
+	frontier *frontier
+	max      int
+	started  time.Time
+	fetched  int
+
+	// Totals of the run
+	pages    int
+	failed   int
+	bytes    int64
+	hosts    map[string]int
+	statuses map[int]int
+}
+
+func newCrawlProgress() *crawlProgress {
+	return &crawlProgress{
+		terminal: isTerminal(os.Stderr),
+		start:    time.Now(),
+		hosts:    map[string]int{},
+		statuses: map[int]int{},
+	}
+}
+
+// begin starts following a spider.
+func (p *crawlProgress) begin(spider string, f *frontier, max int) {
+	p.spider = spider
+	p.frontier = f
+	p.max = max
+	p.started = time.Now()
+	p.lastLog = p.started
+	p.fetched = 0
+}
+
+// end clears the progress of the spider from the terminal.
+func (p *crawlProgress) end() {
+	if p.terminal {
+		progressLine.Clear()
+	}
+}
+
+// add counts the result of a request.
+func (p *crawlProgress) add(r *SpiderResult) {
+	p.fetched++
+	p.pages++
+	if r.Error != "" {
+		p.failed++
+	}
+	p.bytes += int64(len(r.Response))
+	p.hosts[r.URL.Host]++
+	p.statuses[r.StatusCode]++
+}
+
+// tick draws or logs the progress of the spider.
+func (p *crawlProgress) tick(now time.Time) {
+	if p.terminal {
+		progressLine.Draw(p.line(now))
+		return
+	}
+	if now.Sub(p.lastLog) < progressLogInterval {
+		return
+	}
+	p.lastLog = now
+
+	c := p.frontier.Counts()
+	var fields = log.Fields{
+		"queued":   c.Queued,
+		"inFlight": c.InFlight,
+		"fetched":  c.Fetched(),
+		"failed":   c.Failed,
+		"skipped":  c.Skipped,
+		"bytes":    p.bytes,
+		"rate":     fmt.Sprintf("%.1f", p.rate(now)),
+	}
+	if p.spider != "" {
+		fields["spider"] = p.spider
+	}
+	if p.max > 0 {
+		fields["max"] = p.max
+		fields["eta"] = p.eta(now).String()
+	}
+	log.WithFields(fields).Info("Progress")
+}
+
+// line is the progress of the spider as it is drawn on the terminal.
+func (p *crawlProgress) line(now time.Time) string {
+	c := p.frontier.Counts()
+	var line = fmt.Sprintf("%d queued, %d in flight, %d fetched, %d failed, %s, %.1f req/s",
+		c.Queued, c.InFlight, c.Fetched(), c.Failed, formatBytes(p.bytes), p.rate(now))
+	if p.max > 0 {
+		line += fmt.Sprintf(", ETA %s", p.eta(now))
+	}
+	if p.spider != "" {
+		line = p.spider + ": " + line
+	}
+	return line
+}
+
+// rate is how many pages per second the spider has fetched since it started.
+func (p *crawlProgress) rate(now time.Time) float64 {
+	elapsed := now.Sub(p.started).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(p.fetched) / elapsed
+}
+
+// eta is how long the spider will take to fetch max pages at its rate so
+// far, or 0 if it hasn't fetched any yet.
+func (p *crawlProgress) eta(now time.Time) time.Duration {
+	rate := p.rate(now)
+	left := p.max - p.frontier.Counts().Fetched()
+	if rate == 0 || left <= 0 {
+		return 0
+	}
+	return time.Duration(float64(left) / rate * float64(time.Second)).Round(time.Second)
+}
+
+// summary logs the totals of the run, by host and status code.
+func (p *crawlProgress) summary() {
+	log.Infof("Fetched %s, %d failed, %s in %s", plural(p.pages, "page"), p.failed,
+		formatBytes(p.bytes), time.Since(p.start).Round(100*time.Millisecond))
+
+	var hosts = []string{}
+	for host := range p.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if p.hosts[hosts[i]] != p.hosts[hosts[j]] {
+			return p.hosts[hosts[i]] > p.hosts[hosts[j]]
+		}
+		return hosts[i] < hosts[j]
+	})
+	for _, host := range hosts {
+		log.Infof("  %s: %s", host, plural(p.hosts[host], "page"))
+	}
+
+	var statuses = []int{}
+	for status := range p.statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		if status == 0 {
+			log.Infof("  No response: %s", plural(p.statuses[status], "page"))
+			continue
+		}
+		log.Infof("  Status %d: %s", status, plural(p.statuses[status], "page"))
+	}
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
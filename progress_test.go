@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func captureLogs(f func()) string {
+	var buffer = bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	defer log.SetOutput(os.Stderr)
+	f()
+	return buffer.String()
+}
+
+// testProgress returns the progress of a spider which has fetched two
+// pages in two seconds, one of which failed, with one request in flight and
+// one queued.
+func testProgress(t *testing.T, db *leveldb.DB) *crawlProgress {
+	f, err := openFrontier(db, "blog", orderBFS)
+	assert.NoError(t, err)
+	pushRequests(f, testRequest("/a", 0, 0), testRequest("/b", 0, 0), testRequest("/c", 0, 0), testRequest("/d", 0, 0))
+
+	p := newCrawlProgress()
+	p.begin("blog", f, 10)
+	p.started = p.started.Add(-2 * time.Second)
+
+	requests, err := f.Next(3, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Start(requests...))
+	assert.NoError(t, f.Done(requests[0], stateDone))
+	assert.NoError(t, f.Done(requests[1], stateFailed))
+	p.add(&SpiderResult{URL: requests[0].URL, StatusCode: 200, Response: strings.Repeat("a", 2048)})
+	p.add(&SpiderResult{URL: requests[1].URL, StatusCode: 404, Error: http.StatusText(404)})
+	return p
+}
+
+func TestCrawlProgressLine(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	p := testProgress(t, testDB)
+	assert.Equal(t, "blog: 1 queued, 1 in flight, 2 fetched, 1 failed, 2.0 KB, 1.0 req/s, ETA 8s",
+		p.line(p.started.Add(2*time.Second)))
+
+	var buffer = bytes.NewBuffer([]byte{})
+	line := &terminalLine{out: buffer}
+	line.Draw("1 queued")
+	line.Draw("2 queued")
+	assert.NoError(t, line.Fire(nil))
+	line.Clear()
+	assert.Equal(t, "\r\x1b[K1 queued\r\x1b[K2 queued\r\x1b[K", buffer.String())
+}
+
+func TestCrawlProgressLog(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	p := testProgress(t, testDB)
+	p.terminal = false
+	logs := captureLogs(func() {
+		p.tick(p.lastLog.Add(time.Second))
+	})
+	assert.Equal(t, "", logs)
+
+	logs = captureLogs(func() {
+		p.tick(p.lastLog.Add(progressLogInterval))
+	})
+	assert.Contains(t, logs, "Progress")
+	assert.Contains(t, logs, "spider=blog")
+	assert.Contains(t, logs, "queued=1")
+	assert.Contains(t, logs, "inFlight=1")
+	assert.Contains(t, logs, "fetched=2")
+	assert.Contains(t, logs, "bytes=2048")
+	assert.Contains(t, logs, "max=10")
+}
+
+func TestCrawlProgressSummary(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	p := testProgress(t, testDB)
+	logs := captureLogs(p.summary)
+	assert.Contains(t, logs, "Fetched 2 pages, 1 failed, 2.0 KB in")
+	assert.Contains(t, logs, "foo.com: 2 pages")
+	assert.Contains(t, logs, "Status 200: 1 page\"")
+	assert.Contains(t, logs, "Status 404: 1 page\"")
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", formatBytes(512))
+	assert.Equal(t, "1.5 KB", formatBytes(1536))
+	assert.Equal(t, "3.0 MB", formatBytes(3*1024*1024))
+}
+
+func TestScraperSummary(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	for _, path := range []string{"/a", "/b"} {
+		storeResult(testDB, &SpiderResult{
+			URL:      testRequest(path, 0, 0).URL,
+			Response: `<html><body><h1>title</h1></body></html>`,
+		})
+	}
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Options: &ConfigOptions{
+			StoreOptions: &ConfigStoreOptions{Strategy: "memory"},
+		},
+		Scrapers: []*ConfigScraper{
+			&ConfigScraper{
+				Name:   "Test",
+				Output: &ConfigOutput{Path: "test_summary.jsonl"},
+				Fields: map[string]interface{}{"title": "//h1/text()"},
+				Key:    []string{"title"},
+			},
+		},
+	}
+	defer os.Remove("test_summary.jsonl")
+
+	logs := captureLogs(func() {
+		assert.NoError(t, RunScraper(testDB, rugFile, ScrapeOptions{}))
+	})
+	assert.Contains(t, logs, "Scraper Test scraped 2 pages, 0 unchanged, and wrote 1 record, dropping 1 duplicate")
+
+	logs = captureLogs(func() {
+		assert.NoError(t, RunScraper(testDB, rugFile, ScrapeOptions{}))
+	})
+	assert.Contains(t, logs, "Scraper Test scraped 0 pages, 2 unchanged, and wrote 0 records, dropping 0 duplicates")
+}
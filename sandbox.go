@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+	log "github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const defaultTransformTimeout = 5000
+
+// TransformLimits bounds the resources transforms may use. Zero values mean
+// no limit. Timeout applies to each call, while MaxMemory is checked by a
+// memoryLimit once per page.
+type TransformLimits struct {
+	Timeout   time.Duration
+	MaxMemory uint64
+}
+
+func getTransformLimits(options *ConfigOptions) TransformLimits {
+	var timeout = defaultTransformTimeout
+	var maxMemory = 0
+	if options != nil && options.TransformOptions != nil {
+		if options.TransformOptions.Timeout != 0 {
+			timeout = options.TransformOptions.Timeout
+		}
+		maxMemory = options.TransformOptions.MaxMemory
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	return TransformLimits{
+		Timeout:   time.Duration(timeout) * time.Millisecond,
+		MaxMemory: uint64(maxMemory) * 1024 * 1024,
+	}
+}
+
+// sandboxLibs are the standard libraries available to transforms.
+var sandboxLibs = []struct {
+	name string
+	fn   lua.LGFunction
+}{
+	{lua.LoadLibName, lua.OpenPackage},
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+	{lua.CoroutineLibName, lua.OpenCoroutine},
+	{lua.OsLibName, lua.OpenOs},
+}
+
+// sandboxOsFuncs are the functions kept from the os library.
+var sandboxOsFuncs = []string{"clock", "date", "difftime", "time"}
+
+// newSandboxState creates a Lua state without access to the file system,
+// the environment or other processes. Modules can only be loaded with require
+// if they have been preloaded.
+func newSandboxState() *lua.LState {
+	l := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range sandboxLibs {
+		l.Push(l.NewFunction(lib.fn))
+		l.Push(lua.LString(lib.name))
+		l.Call(1, 0)
+	}
+
+	for _, name := range []string{"dofile", "loadfile"} {
+		l.SetGlobal(name, lua.LNil)
+	}
+
+	// print would otherwise write to stdout, which may be a scraper output
+	l.SetGlobal("print", l.NewFunction(func(l *lua.LState) int {
+		var args = []string{}
+		for i := 1; i <= l.GetTop(); i++ {
+			args = append(args, l.ToStringMeta(l.Get(i)).String())
+		}
+		log.Info(strings.Join(args, "\t"))
+		return 0
+	}))
+
+	osLib := l.NewTable()
+	for _, name := range sandboxOsFuncs {
+		osLib.RawSetString(name, l.GetField(l.GetGlobal(lua.OsLibName), name))
+	}
+	l.SetGlobal(lua.OsLibName, osLib)
+	// require returns modules from package.loaded, which still holds the
+	// full os library
+	if loaded, ok := l.GetField(l.GetGlobal(lua.LoadLibName), "loaded").(*lua.LTable); ok {
+		loaded.RawSetString(lua.OsLibName, osLib)
+	}
+
+	// Only keep the preload loader, so that require can't read Lua files
+	if loaders, ok := l.GetField(l.GetGlobal(lua.LoadLibName), "loaders").(*lua.LTable); ok {
+		for i := loaders.Len(); i > 1; i-- {
+			loaders.Remove(i)
+		}
+	}
+	l.SetField(l.GetGlobal(lua.LoadLibName), "path", lua.LString(""))
+
+	return l
+}
+
+// jsMaxCallStackSize limits the recursion of JavaScript transforms.
+const jsMaxCallStackSize = 10000
+
+// newSandboxRuntime creates a JavaScript runtime for a transform. Runtimes
+// only have the standard built-in objects, so transforms can't access the file
+// system, the network or other processes. console writes to the log.
+func newSandboxRuntime() *goja.Runtime {
+	vm := goja.New()
+	vm.SetMaxCallStackSize(jsMaxCallStackSize)
+
+	console := vm.NewObject()
+	logFunc := func(fn func(args ...interface{})) func(call goja.FunctionCall) goja.Value {
+		return func(call goja.FunctionCall) goja.Value {
+			var args = []string{}
+			for _, arg := range call.Arguments {
+				args = append(args, arg.String())
+			}
+			fn(strings.Join(args, " "))
+			return goja.Undefined()
+		}
+	}
+	console.Set("log", logFunc(log.Info))
+	console.Set("info", logFunc(log.Info))
+	console.Set("debug", logFunc(log.Debug))
+	console.Set("warn", logFunc(log.Warn))
+	console.Set("error", logFunc(log.Error))
+	vm.Set("console", console)
+
+	return vm
+}
+
+// callWithLimits runs fn, which calls into a transform, stopping it if it
+// exceeds the time limit. interrupt is called with a context which is
+// cancelled when the limit is exceeded, and should arrange for fn to stop when
+// it is. It returns a function which is called once fn has returned.
+func callWithLimits(name string, limits TransformLimits, interrupt func(ctx context.Context) func(), fn func() error) error {
+	if limits.Timeout == 0 {
+		return fn()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), limits.Timeout)
+	defer cancel()
+
+	release := interrupt(ctx)
+	err := fn()
+	release()
+
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Transform %s exceeded its time limit of %s", name, limits.Timeout)
+	}
+	return err
+}
+
+// memoryLimit stops a scraper once the heap has grown by more than the memory
+// limit since it started, such as when transforms accumulate globals. Neither
+// interpreter can bound the memory of a single call, so the heap of the whole
+// process is sampled instead, once per page rather than on every call, as
+// reading it stops the world. The limit is therefore approximate, and counts
+// everything rugburn allocates, not only transforms.
+type memoryLimit struct {
+	max  uint64
+	base uint64
+}
+
+func newMemoryLimit(limits TransformLimits) *memoryLimit {
+	m := &memoryLimit{max: limits.MaxMemory}
+	if m.max > 0 {
+		m.base = heapAlloc()
+	}
+	return m
+}
+
+// check returns an error if the heap has grown by more than the limit. The
+// heap is collected before giving up, so that garbage isn't counted.
+func (m *memoryLimit) check() error {
+	if m.max == 0 || heapAlloc() < m.base+m.max {
+		return nil
+	}
+	runtime.GC()
+	if heapAlloc() < m.base+m.max {
+		return nil
+	}
+	return fmt.Errorf("Transforms exceeded their memory limit of %d MB", m.max/1024/1024)
+}
+
+func heapAlloc() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// luaInterrupt stops a Lua state when ctx is cancelled.
+func luaInterrupt(l *lua.LState) func(ctx context.Context) func() {
+	return func(ctx context.Context) func() {
+		l.SetContext(ctx)
+		return func() {
+			l.RemoveContext()
+		}
+	}
+}
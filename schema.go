@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// schemaFile is where the JSON Schema of rug.json is published, so that
+// editors can use it.
+const schemaFile = "rug.schema.json"
+
+// schemaField describes a field of the config types in the JSON Schema.
+// Every field needs one, and the schema test fails if a field is added
+// without it.
+type schemaField struct {
+	Description string
+	Enum        []string
+	Default     interface{}
+	Minimum     interface{}
+	Required    bool
+}
+
+// schemaTypes describes the config types. Types which can also be given as
+// a string describe the string form in schemaStrings.
+var schemaTypes = map[string]string{
+	"RugFile":                "A rugburn project.",
+	"ConfigOptions":          "Options for the spider, the store and transforms.",
+	"ConfigSpiderOptions":    "Options for the spider.",
+	"ConfigStoreOptions":     "Options for the store of fetched pages.",
+	"ConfigTransformOptions": "Limits for Lua and JavaScript transforms.",
+	"ConfigSpider":           "Where a spider starts and which links it follows.",
+	"ConfigSpiderOverrides":  "Options for this spider, overriding options.spiders.",
+	"ConfigLinkRule":         "A rule selecting links for the spider to fetch, and how to follow them.",
+	"ConfigScraper":          "A scraper, which scrapes records from fetched pages into an output.",
+	"ConfigOutput":           "Where a scraper writes its records.",
+	"ConfigTransform":        "A transform, given as a file or inline.",
+}
+
+var schemaStrings = map[string]string{
+	"ConfigLinkRule":  "An XPath selecting links to fetch and follow.",
+	"ConfigOutput":    "The path of a JSON Lines file, or - for stdout.",
+	"ConfigTransform": "The path of a Lua or JavaScript transform.",
+}
+
+var schemaFields = map[string]schemaField{
+	"RugFile.$schema":   {Description: "The JSON Schema of this file, for editors."},
+	"RugFile.include":   {Description: "Configs to merge into this one, relative to it. Their scrapers are added before this config's own."},
+	"RugFile.name":      {Description: "The name of the project."},
+	"RugFile.options":   {Description: "Options for the spider, the store and transforms.", Required: true},
+	"RugFile.spider":    {Description: "Where the spider starts and which links it follows. Either spider or spiders is required."},
+	"RugFile.spiders":   {Description: "Named spiders, which are run in turn and store their pages separately."},
+	"RugFile.fieldSets": {Description: "Named sets of fields, which scrapers add to their fields with $use."},
+	"RugFile.scrapers":  {Description: "The scrapers to run over the fetched pages."},
+
+	"ConfigOptions.spiders":    {Description: "Options for the spider. Required, unless every spider sets its own concurrency."},
+	"ConfigOptions.store":      {Description: "Options for the store of fetched pages.", Required: true},
+	"ConfigOptions.transforms": {Description: "Limits for Lua and JavaScript transforms."},
+
+	"ConfigSpiderOptions.concurrency": {Description: "How many requests to make at once. Required, unless every spider sets its own.", Minimum: 1},
+	"ConfigSpiderOptions.max":         {Description: "The most pages to fetch, or 0 for no limit.", Minimum: 0, Default: 0},
+	"ConfigSpiderOptions.order": {
+		Description: "The order pages are fetched in: breadth first, depth first, or by the priority of their link rule.",
+		Enum:        []string{orderBFS, orderDFS, orderPriority},
+		Default:     orderBFS,
+	},
+
+	"ConfigStoreOptions.strategy": {
+		Description: "Whether fetched pages are kept on disk in ./db, or only in memory for this run.",
+		Enum:        []string{strategyDisk, strategyMem},
+		Required:    true,
+	},
+
+	"ConfigTransformOptions.timeout":   {Description: "The time limit in milliseconds, or -1 for no limit.", Minimum: -1, Default: defaultTransformTimeout},
+	"ConfigTransformOptions.maxMemory": {Description: "How many MB the heap of the whole process may grow by while scraping, checked after each page, or 0 for no limit.", Minimum: 0, Default: 0},
+
+	"ConfigSpider.name":    {Description: "The name of the spider, used by run --spider and by scrapers. Required in spiders."},
+	"ConfigSpider.urls":    {Description: "The URLs the spider starts from.", Required: true},
+	"ConfigSpider.test":    {Description: "An XPath which pages must match for their links to be followed."},
+	"ConfigSpider.links":   {Description: "Rules selecting the links to follow."},
+	"ConfigSpider.options": {Description: "Options for this spider, overriding options.spiders."},
+
+	"ConfigLinkRule.name":     {Description: "The name of the rule, which is stored with the requests for the links it finds."},
+	"ConfigLinkRule.xpath":    {Description: "An XPath selecting the links.", Required: true},
+	"ConfigLinkRule.follow":   {Description: "Whether the links of the pages found are followed, or only fetched.", Default: true},
+	"ConfigLinkRule.maxDepth": {Description: "How many links away from a start URL the links may be, or 0 for no limit.", Minimum: 0, Default: 0},
+	"ConfigLinkRule.priority": {Description: "The priority of the links found, for the priority order. Higher is fetched sooner.", Default: 0},
+	"ConfigLinkRule.include":  {Description: "Regular expressions, one of which the URLs of links must match."},
+	"ConfigLinkRule.exclude":  {Description: "Regular expressions which the URLs of links must not match."},
+
+	"ConfigSpiderOverrides.concurrency": {Description: "How many requests to make at once.", Minimum: 1},
+	"ConfigSpiderOverrides.max":         {Description: "The most pages to fetch, or 0 for no limit.", Minimum: 0},
+	"ConfigSpiderOverrides.order": {
+		Description: "The order pages are fetched in: breadth first, depth first, or by the priority of their link rule.",
+		Enum:        []string{orderBFS, orderDFS, orderPriority},
+	},
+
+	"ConfigScraper.name":    {Description: "The name of the scraper, used by run --scraper. Required."},
+	"ConfigScraper.output":  {Description: "Where the scraper writes its records. Required, unless the scraper extends another."},
+	"ConfigScraper.test":    {Description: "An XPath which pages must match to be scraped."},
+	"ConfigScraper.context": {Description: "An XPath selecting the nodes to scrape a record from. Defaults to one record per page."},
+	"ConfigScraper.fields": {
+		Description: "The fields of each record, as XPaths relative to the context. Required, unless the scraper extends another.",
+	},
+	"ConfigScraper.transforms": {Description: "Transforms which records are passed through in turn."},
+	"ConfigScraper.key":        {Description: "Fields which identify a record, used to deduplicate records."},
+	"ConfigScraper.extends":    {Description: "The name of a scraper whose config this scraper inherits and overrides."},
+	"ConfigScraper.spiders":    {Description: "Scrape only the pages fetched by these spiders. Defaults to every spider."},
+	"ConfigScraper.dedupe": {
+		Description: "Which record is kept when several have the same key. last and merge require a sqlite output with the same key.",
+		Enum:        []string{dedupeFirst, dedupeLast, dedupeMerge},
+		Default:     dedupeFirst,
+	},
+	"ConfigScraper.onTransformError": {
+		Description: "Whether a failing transform stops the run, or is logged and the record dropped.",
+		Enum:        []string{transformErrorAbort, transformErrorSkip},
+		Default:     transformErrorAbort,
+	},
+
+	"ConfigOutput.type": {
+		Description: "The format of the output.",
+		Enum:        []string{outputJSONL, outputCSV, outputSQLite, outputParquet},
+		Default:     outputJSONL,
+	},
+	"ConfigOutput.path":    {Description: "The path of the output, or - for stdout.", Required: true},
+	"ConfigOutput.columns": {Description: "The fields to write, in order. Required for csv, sqlite and parquet outputs."},
+	"ConfigOutput.table":   {Description: "The SQLite table to write to. Required for sqlite outputs."},
+	"ConfigOutput.key":     {Description: "Columns which identify a row, so that SQLite rows are replaced rather than duplicated."},
+
+	"ConfigTransform.path":   {Description: "The path of a Lua or JavaScript transform."},
+	"ConfigTransform.lua":    {Description: "The source of a Lua transform."},
+	"ConfigTransform.js":     {Description: "The source of a JavaScript transform."},
+	"ConfigTransform.set":    {Description: "Fields to set to the result of an expression."},
+	"ConfigTransform.rename": {Description: "Fields to rename."},
+	"ConfigTransform.drop":   {Description: "Fields to remove."},
+	"ConfigTransform.where":  {Description: "An expression which records must match to be kept."},
+}
+
+// schemaOverrides are the schemas of fields which can't be derived from
+// their Go type.
+var schemaOverrides = map[string]map[string]interface{}{
+	"ConfigScraper.fields": {"$ref": "#/definitions/fields"},
+	"RugFile.fieldSets": {
+		"type":                 "object",
+		"additionalProperties": map[string]interface{}{"$ref": "#/definitions/fields"},
+	},
+}
+
+// fieldsSchema is the schema of the fields of a scraper or a field set, which
+// may use other field sets.
+var fieldsSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		useKey: map[string]interface{}{
+			"description": "Field sets whose fields are added to these.",
+			"anyOf": []interface{}{
+				map[string]interface{}{"type": "string"},
+				map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			},
+		},
+	},
+	"additionalProperties": map[string]interface{}{"$ref": "#/definitions/field"},
+}
+
+// fieldSchema is the schema of a scraper field, which is either an XPath or
+// an object.
+var fieldSchema = map[string]interface{}{
+	"description": "An XPath, or an object with an XPath or nested fields.",
+	"anyOf": []interface{}{
+		map[string]interface{}{"type": "string"},
+		map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": false,
+			"properties": map[string]interface{}{
+				"xpath": map[string]interface{}{
+					"type":        "string",
+					"description": "An XPath relative to the context.",
+				},
+				"context": map[string]interface{}{
+					"type":        "string",
+					"description": "An XPath selecting the nodes to scrape the nested fields from.",
+				},
+				"fields": map[string]interface{}{
+					"allOf":       []interface{}{map[string]interface{}{"$ref": "#/definitions/fields"}},
+					"description": "Nested fields, scraped into an array of objects.",
+				},
+				"transform": map[string]interface{}{
+					"type":        "string",
+					"description": "The path of a Lua or JavaScript transform which is passed the value of the field.",
+				},
+			},
+		},
+	},
+}
+
+// configSchema returns the JSON Schema of rug.json, derived from RugFile.
+func configSchema() map[string]interface{} {
+	var definitions = map[string]interface{}{
+		"field":  fieldSchema,
+		"fields": fieldsSchema,
+	}
+	root := typeSchema(reflect.TypeOf(RugFile{}), definitions)
+	return map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "rug.json",
+		"$ref":        root["$ref"],
+		"definitions": definitions,
+	}
+}
+
+// configSchemaJSON returns the JSON Schema of rug.json as it is published.
+func configSchemaJSON() ([]byte, error) {
+	j, err := json.MarshalIndent(configSchema(), "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(j, '\n'), nil
+}
+
+func typeSchema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := definitions[name]; !ok {
+			// Added before the fields, in case the type contains itself
+			definitions[name] = nil
+			definitions[name] = structSchema(t, definitions)
+		}
+		ref := map[string]interface{}{"$ref": "#/definitions/" + name}
+		if s, ok := schemaStrings[name]; ok {
+			return map[string]interface{}{
+				"anyOf": []interface{}{
+					map[string]interface{}{"type": "string", "description": s},
+					ref,
+				},
+			}
+		}
+		return ref
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem(), definitions),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem(), definitions),
+		}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	var properties = map[string]interface{}{}
+	var required = []string{}
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		key := t.Name() + "." + name
+
+		var property map[string]interface{}
+		if override, ok := schemaOverrides[key]; ok {
+			property = override
+		} else {
+			property = typeSchema(t.Field(i).Type, definitions)
+		}
+
+		// Keywords next to a $ref are ignored, so wrap it
+		if _, ok := property["$ref"]; ok {
+			property = map[string]interface{}{"allOf": []interface{}{property}}
+		} else {
+			copied := map[string]interface{}{}
+			for k, v := range property {
+				copied[k] = v
+			}
+			property = copied
+		}
+
+		field := schemaFields[key]
+		if field.Description != "" {
+			property["description"] = field.Description
+		}
+		if field.Enum != nil {
+			property["enum"] = field.Enum
+		}
+		if field.Default != nil {
+			property["default"] = field.Default
+		}
+		if field.Minimum != nil {
+			property["minimum"] = field.Minimum
+		}
+		if field.Required {
+			required = append(required, name)
+		}
+		properties[name] = property
+	}
+
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"description":          schemaTypes[t.Name()],
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// configTypes returns the config types reachable from RugFile.
+func configTypes(t reflect.Type, types map[string]reflect.Type) {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+		configTypes(t.Elem(), types)
+	case reflect.Struct:
+		if _, ok := types[t.Name()]; ok {
+			return
+		}
+		types[t.Name()] = t
+		for i := 0; i < t.NumField(); i++ {
+			configTypes(t.Field(i).Type, types)
+		}
+	}
+}
+
+func TestSchemaDescribesEveryField(t *testing.T) {
+	var types = map[string]reflect.Type{}
+	configTypes(reflect.TypeOf(RugFile{}), types)
+
+	var fields = map[string]bool{}
+	for name, typ := range types {
+		assert.NotEmpty(t, schemaTypes[name], "Missing description of %s in schemaTypes", name)
+		for i := 0; i < typ.NumField(); i++ {
+			key := name + "." + jsonName(typ.Field(i))
+			fields[key] = true
+			assert.NotEmpty(t, schemaFields[key].Description, "Missing description of %s in schemaFields", key)
+		}
+	}
+
+	for key := range schemaFields {
+		assert.True(t, fields[key], "schemaFields describes %s, which isn't a config field", key)
+	}
+	for name := range schemaTypes {
+		_, ok := types[name]
+		assert.True(t, ok, "schemaTypes describes %s, which isn't a config type", name)
+	}
+}
+
+func TestSchemaFileUpToDate(t *testing.T) {
+	published, err := ioutil.ReadFile(schemaFile)
+	assert.NoError(t, err)
+
+	generated, err := configSchemaJSON()
+	assert.NoError(t, err)
+
+	assert.Equal(t, string(generated), string(published), "%s is out of date. Run \"rugburn schema > %s\" to update it.", schemaFile, schemaFile)
+}
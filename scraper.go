@@ -2,197 +2,655 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"os"
+	"sort"
+	"strings"
 
 	libxml2 "github.com/lestrrat/go-libxml2"
 	"github.com/lestrrat/go-libxml2/types"
 	"github.com/lestrrat/go-libxml2/xpath"
 	log "github.com/sirupsen/logrus"
 	"github.com/syndtr/goleveldb/leveldb"
-	lua "github.com/yuin/gopher-lua"
-	luajson "layeh.com/gopher-json"
 )
 
+const transformErrorAbort = "abort"
+const transformErrorSkip = "skip"
+
+// scrapedBatchSize is how many pages a scraper scrapes between flushes of its
+// output, after which the pages are marked as scraped.
+const scrapedBatchSize = 100
+
 type ScrapeJob struct {
-	config     *ConfigScraper
-	transforms []string
-	output     *os.File
+	config          *ConfigScraper
+	transforms      []Transform
+	fieldTransforms map[string]ScriptTransform
+	output          OutputSink
+	hash            string
+	dedupe          *deduper
+	// scraped holds the hashes of the pages scraped since the output was
+	// last flushed, along with the keys of their records for dedupe. They
+	// are stored once the records of the pages are in the output, so a run
+	// which crashes scrapes them again. unstored is how many pages it holds.
+	scraped  *leveldb.Batch
+	unstored int
+
+	// How many pages were scraped and left as they hadn't changed, and how
+	// many records were written, for the summary
+	pages     int
+	unchanged int
+	records   int
 }
 
-func RunScraper(db *leveldb.DB, rugFile *RugFile) error {
+type ScrapeOptions struct {
+	// Full truncates the outputs and scrapes every page again
+	Full bool
+	// Scraper runs only the scraper with this name, if set
+	Scraper string
+	// Stop stops the scrapers between pages when it is closed. Outputs are
+	// still flushed, and the remaining pages are scraped by the next run.
+	Stop <-chan struct{}
+}
+
+// RunScraper runs the configured scrapers over the stored spider results.
+// Pages which a scraper has already processed with the same configuration
+// are skipped, unless options.Full is set.
+func RunScraper(db *leveldb.DB, rugFile *RugFile, options ScrapeOptions) (err error) {
 	iter := getResultIterator(db)
+	defer iter.Release()
 
 	var jobs = []*ScrapeJob{}
-	for _, sc := range rugFile.Scrapers {
-		f, err := os.OpenFile(sc.Output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	defer func() {
+		for _, job := range jobs {
+			closeTransforms(job.transforms)
+			closeFieldTransforms(job.fieldTransforms)
+			cerr := job.output.Close()
+			if cerr == nil {
+				cerr = job.storeScraped(db, true)
+			}
+			if err == nil {
+				err = cerr
+			}
+		}
+	}()
+
+	var scrapers = rugFile.Scrapers
+	if options.Scraper != "" {
+		scrapers = nil
+		for _, sc := range rugFile.Scrapers {
+			if sc.Name == options.Scraper {
+				scrapers = append(scrapers, sc)
+			}
+		}
+		if len(scrapers) == 0 {
+			return fmt.Errorf("Can't find a scraper named \"%s\"", options.Scraper)
+		}
+	}
+
+	for _, sc := range scrapers {
+		switch sc.OnTransformError {
+		case "", transformErrorAbort, transformErrorSkip:
+		default:
+			return fmt.Errorf("Unknown onTransformError policy \"%s\" for scraper %s", sc.OnTransformError, sc.Name)
+		}
+
+		sources, transforms, err := loadTransforms(rugFile.Options, sc)
 		if err != nil {
 			return err
 		}
 
-		var transforms = []string{}
-		for _, t := range sc.Transforms {
-			// Open transforms
-			tByte, err := ioutil.ReadFile(t)
-			if err != nil {
-				return err
-			}
-			transforms = append(transforms, string(tByte))
+		fieldSources, fieldTransforms, err := loadFieldTransforms(rugFile.Options, sc)
+		if err != nil {
+			closeTransforms(transforms)
+			return err
 		}
 
-		defer f.Close()
-
-		job := &ScrapeJob{
-			config:     sc,
-			output:     f,
-			transforms: transforms,
+		job, err := openScrapeJob(db, sc, options, transforms, fieldTransforms, append(sources, fieldSources...))
+		if err != nil {
+			closeTransforms(transforms)
+			closeFieldTransforms(fieldTransforms)
+			return err
 		}
 
 		jobs = append(jobs, job)
 	}
 
+	memory := newMemoryLimit(getTransformLimits(rugFile.Options))
+	var interrupted = false
 	for iter.Next() {
+		if stopped(options.Stop) {
+			interrupted = true
+			break
+		}
+
+		rv := iter.Value()
+		var buffer = bytes.NewBuffer(rv)
+		var r = &SpiderResult{}
+		d := gob.NewDecoder(buffer)
+		err := d.Decode(r)
+		if err != nil {
+			return err
+		}
+
 		for _, job := range jobs {
-			rv := iter.Value()
-			var buffer = bytes.NewBuffer(rv)
-			var r = &SpiderResult{}
-			d := gob.NewDecoder(buffer)
-			err := d.Decode(r)
+			if len(job.config.Spiders) > 0 && !containsString(job.config.Spiders, r.Spider) {
+				continue
+			}
+
+			url := spiderKey(r.Spider, r.URL.String())
+			pageHash := hashStrings(job.hash, r.Response)
 
+			storedHash, err := getScrapedHash(db, job.config.Name, url)
 			if err != nil {
 				return err
 			}
+			if storedHash == pageHash {
+				log.Debugf("Scraper %s already processed %s.. skipping", job.config.Name, url)
+				job.unchanged++
+				continue
+			}
 
-			doc, err := libxml2.ParseHTMLString(r.Response)
+			results, err := scrapePage(job, r)
 			if err != nil {
 				return err
 			}
+			job.pages++
 
-			ctx, err := xpath.NewContext(doc)
+			for _, r := range results {
+				if err = job.write(r); err != nil {
+					return err
+				}
+			}
+
+			putScrapedHash(job.scraped, job.config.Name, url, pageHash)
+			job.unstored++
+			err = job.storeScraped(db, false)
 			if err != nil {
 				return err
 			}
+		}
 
-			defer ctx.Free()
-
-			if job.config.Test != "" {
-				xpTest, err := ctx.Find(job.config.Test)
-				if err != nil {
-					return err
-				}
+		err = memory.check()
+		if err != nil {
+			return err
+		}
+	}
 
-				if len(xpTest.NodeList()) == 0 {
-					return nil
-				}
+	err = iter.Error()
+	if err != nil {
+		return err
+	}
 
-				defer xpTest.Free()
+	for _, job := range jobs {
+		// The transforms of an interrupted run haven't seen every page, so
+		// they aren't finished. Their outputs are still flushed and closed.
+		// Nor are those of a run which scraped no pages, as they would only
+		// aggregate nothing.
+		if !interrupted && job.pages > 0 {
+			err = job.finish()
+			if err != nil {
+				return err
 			}
+		}
 
-			var results = []map[string]interface{}{}
-			if job.config.Context != "" {
-				xpContext, err := ctx.Find(job.config.Context)
-				if err != nil {
-					return err
-				}
+		if job.dedupe == nil {
+			continue
+		}
+		err = job.dedupe.Flush(job.output)
+		if err != nil {
+			return err
+		}
+		job.records += job.dedupe.flushed
+	}
 
-				defer xpContext.Free()
+	for _, job := range jobs {
+		log.Info(job.summary())
+	}
 
-				for _, r := range xpContext.NodeList() {
-					result, err := parseFields(job.config.Fields, r)
-					if err != nil {
-						return err
-					}
-					results = append(results, result)
-				}
-			} else {
-				result, err := parseFields(job.config.Fields, doc)
-				if err != nil {
-					return err
-				}
-				results = append(results, result)
+	if interrupted {
+		return errStopped
+	}
+	log.Info("..Done!")
+	return nil
+}
 
-			}
+// openScrapeJob opens the output of a scraper and the store of its
+// duplicates. A scraper with a transform which aggregates in finish scrapes
+// every page again, as for options.Full, so that the records of its finish
+// replace those of the last run rather than only covering the changed pages.
+func openScrapeJob(db *leveldb.DB, sc *ConfigScraper, options ScrapeOptions, transforms []Transform, fieldTransforms map[string]ScriptTransform, sources []string) (*ScrapeJob, error) {
+	var full = options.Full
+	for _, t := range transforms {
+		if t.Finishes() && !full {
+			log.Infof("Transform %s of scraper %s defines finish, so every page is scraped again", t.Name(), sc.Name)
+			full = true
+		}
+	}
 
-			for _, t := range job.transforms {
-				for i, r := range results {
-					result, err := ApplyTransform(r, t)
-					if err != nil {
-						return err
-					}
-					results[i] = result
-				}
-			}
+	if full {
+		err := clearScraped(db, sc.Name)
+		if err != nil {
+			return nil, err
+		}
+		err = clearDedupe(db, sc.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			for _, r := range results {
-				if len(r) == 0 {
-					continue
-				}
-				j, err := json.Marshal(r)
-				if err != nil {
-					return err
-				}
-				if _, err = job.output.WriteString(string(j) + "\n"); err != nil {
-					return err
-				}
-			}
+	scraped := new(leveldb.Batch)
+	dedupe, err := newDeduper(db, sc, scraped)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := configHash(sc, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := openOutput(sc.Output, full)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScrapeJob{
+		config:          sc,
+		output:          output,
+		transforms:      transforms,
+		fieldTransforms: fieldTransforms,
+		hash:            hash,
+		dedupe:          dedupe,
+		scraped:         scraped,
+	}, nil
+}
 
+// write writes a record to the output of the job, unless it is empty or a
+// duplicate.
+func (job *ScrapeJob) write(r map[string]interface{}) error {
+	if len(r) == 0 {
+		return nil
+	}
+	if job.dedupe != nil {
+		write, err := job.dedupe.Add(r)
+		if err != nil {
+			return err
+		}
+		if !write {
+			return nil
 		}
 	}
-	iter.Release()
-	err := iter.Error()
+	err := job.output.Write(r)
 	if err != nil {
 		return err
 	}
-	log.Info("..Done!")
+	job.records++
 	return nil
 }
 
-func ApplyTransform(result map[string]interface{}, transform string) (map[string]interface{}, error) {
-	s, err := json.Marshal(result)
+// storeScraped stores the hashes of the pages scraped since it was last
+// called, once their records are durable: every scrapedBatchSize pages if the
+// output can be flushed, and otherwise when it has been closed.
+func (job *ScrapeJob) storeScraped(db *leveldb.DB, closed bool) error {
+	if job.scraped.Len() == 0 {
+		return nil
+	}
+	if !closed {
+		f, ok := job.output.(outputFlusher)
+		if !ok || job.unstored < scrapedBatchSize {
+			return nil
+		}
+		err := f.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	err := db.Write(job.scraped, nil)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	job.scraped.Reset()
+	job.unstored = 0
+	if job.dedupe != nil {
+		job.dedupe.stored()
+	}
+	return nil
+}
+
+// summary sums up the run of the job.
+func (job *ScrapeJob) summary() string {
+	var summary = fmt.Sprintf("Scraper %s scraped %s, %d unchanged, and wrote %s", job.config.Name,
+		plural(job.pages, "page"), job.unchanged, plural(job.records, "record"))
+	if job.dedupe != nil {
+		summary += fmt.Sprintf(", dropping %s", plural(job.dedupe.duplicates, "duplicate"))
+	}
+	return summary
+}
+
+// finish calls the finish function of each transform in turn. The records it
+// returns are passed through the transforms which follow it before being
+// written. Scrapers with a transform which defines finish scrape every page,
+// so finish covers all of them.
+func (job *ScrapeJob) finish() error {
+	for i, t := range job.transforms {
+		results, err := t.Finish()
+		if err != nil {
+			return err
+		}
+
+		var records = []pageRecord{}
+		for _, r := range results {
+			records = append(records, pageRecord{fields: r})
+		}
+
+		records, err = applyTransforms(job, job.transforms[i+1:], records, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range records {
+			err = job.write(r.fields)
+			if err != nil {
+				return err
+			}
+		}
 	}
-	l := lua.NewState()
-	defer l.Close()
-	luajson.Preload(l)
-	l.SetGlobal("result", lua.LString(s))
-	err = l.DoString(`
-		json = require("json")
-		oresult = json.decode(result)
-
-		function do_transform()
-			value = transform(oresult)
-			return json.encode(value)
-		end	
-	`)
+	return nil
+}
+
+// loadTransforms reads and compiles the transforms of a scraper, returning
+// the sources of any Lua transform files along with the compiled transforms.
+func loadTransforms(options *ConfigOptions, sc *ConfigScraper) ([]string, []Transform, error) {
+	limits := getTransformLimits(options)
+	var sources = []string{}
+	var transforms = []Transform{}
+	for i, t := range sc.Transforms {
+		transform, source, err := loadTransform(fmt.Sprintf("%s.transforms[%d]", sc.Name, i), t, limits)
+		if err != nil {
+			closeTransforms(transforms)
+			return nil, nil, err
+		}
+		sources = append(sources, source)
+		transforms = append(transforms, transform)
+	}
+	return sources, transforms, nil
+}
+
+func loadTransform(name string, config *ConfigTransform, limits TransformLimits) (Transform, string, error) {
+	var kinds = 0
+	for _, set := range []bool{config.Path != "", config.Lua != "", config.JS != "", config.isExpr()} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return nil, "", fmt.Errorf("Transform %s must have exactly one of a path, inline Lua, inline JavaScript, or expressions", name)
+	}
+
+	switch {
+	case config.Path != "":
+		return loadScript(config.Path, limits)
+	case config.Lua != "":
+		t, err := NewLuaTransform(name, config.Lua, limits)
+		return t, "", err
+	case config.JS != "":
+		t, err := NewJSTransform(name, config.JS, limits)
+		return t, "", err
+	default:
+		t, err := NewExprTransform(name, config)
+		return t, "", err
+	}
+}
+
+// loadScript reads and compiles a Lua or JavaScript transform file, returning
+// the transform along with its source.
+func loadScript(path string, limits TransformLimits) (ScriptTransform, string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if strings.HasSuffix(path, ".js") {
+		t, err := NewJSTransform(path, string(b), limits)
+		if err != nil {
+			return nil, "", err
+		}
+		return t, string(b), nil
+	}
+	t, err := NewLuaTransform(path, string(b), limits)
+	if err != nil {
+		return nil, "", err
+	}
+	return t, string(b), nil
+}
+
+// loadFieldTransforms reads and compiles the transforms of the fields of a
+// scraper, returning their sources along with the transforms keyed by path.
+func loadFieldTransforms(options *ConfigOptions, sc *ConfigScraper) ([]string, map[string]ScriptTransform, error) {
+	var paths = map[string]bool{}
+	err := fieldTransformPaths(sc.Fields, paths)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var sorted = []string{}
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	limits := getTransformLimits(options)
+	var sources = []string{}
+	var transforms = make(map[string]ScriptTransform)
+	for _, path := range sorted {
+		t, source, err := loadScript(path, limits)
+		if err != nil {
+			closeFieldTransforms(transforms)
+			return nil, nil, err
+		}
+		sources = append(sources, source)
+		transforms[path] = t
+	}
+	return sources, transforms, nil
+}
+
+func fieldTransformPaths(fields map[string]interface{}, paths map[string]bool) error {
+	for k, v := range fields {
+		f, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if t, ok := f["transform"]; ok {
+			path, ok := t.(string)
+			if !ok {
+				return fmt.Errorf("Unexpected type for value \"transform\" of field \"%s\". Should be string.", k)
+			}
+			paths[path] = true
+		}
+		if nested, ok := f["fields"].(map[string]interface{}); ok {
+			err := fieldTransformPaths(nested, paths)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func closeTransforms(transforms []Transform) {
+	for _, t := range transforms {
+		t.Close()
+	}
+}
+
+func closeFieldTransforms(transforms map[string]ScriptTransform) {
+	for _, t := range transforms {
+		t.Close()
+	}
+}
+
+// TransformError is a runtime error from a transform, along with the record
+// and page it was transforming.
+type TransformError struct {
+	Scraper   string
+	Transform string
+	URL       string
+	Record    map[string]interface{}
+	Err       error
+}
+
+func (e *TransformError) Error() string {
+	record, _ := json.Marshal(e.Record)
+	return fmt.Sprintf("Transform %s failed in scraper %s on %s: %s\nRecord: %s", e.Transform, e.Scraper, e.URL, e.Err, record)
+}
+
+// pageRecord is a record along with the node it was scraped from.
+type pageRecord struct {
+	fields map[string]interface{}
+	node   types.Node
+}
+
+func scrapePage(job *ScrapeJob, page *SpiderResult) ([]map[string]interface{}, error) {
+	var results = []map[string]interface{}{}
+
+	doc, err := libxml2.ParseHTMLString(page.Response)
 	if err != nil {
 		return nil, err
 	}
-	l.DoString(transform)
-	if err := l.CallByParam(lua.P{
-		Fn:      l.GetGlobal("do_transform"),
-		NRet:    1,
-		Protect: true,
-	}, l.GetGlobal("oresult")); err != nil {
+
+	defer doc.Free()
+
+	ctx, err := xpath.NewContext(doc)
+	if err != nil {
 		return nil, err
 	}
-	ret := l.Get(-1)
-	l.Pop(1)
 
-	vmResultString := ret.String()
-	var vmResult = make(map[string]interface{})
-	err = json.Unmarshal([]byte(vmResultString), &vmResult)
+	defer ctx.Free()
+
+	if job.config.Test != "" {
+		xpTest, err := ctx.Find(job.config.Test)
+		if err != nil {
+			return nil, err
+		}
+
+		defer xpTest.Free()
+
+		if len(xpTest.NodeList()) == 0 {
+			return results, nil
+		}
+	}
+
+	var nodes = []types.Node{doc}
+	if job.config.Context != "" {
+		xpContext, err := ctx.Find(job.config.Context)
+		if err != nil {
+			return nil, err
+		}
+
+		defer xpContext.Free()
+
+		nodes = xpContext.NodeList()
+	}
+
+	var records = []pageRecord{}
+	for _, n := range nodes {
+		result, err := parseFields(job.config.Fields, n, job.fieldTransforms)
+		if terr, ok := err.(*TransformError); ok {
+			terr.Scraper = job.config.Name
+			terr.URL = page.URL.String()
+			if job.config.OnTransformError == transformErrorSkip {
+				log.Warn(terr)
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, pageRecord{result, n})
+	}
+
+	records, err = applyTransforms(job, job.transforms, records, page)
 	if err != nil {
 		return nil, err
 	}
 
-	return vmResult, nil
+	for _, r := range records {
+		results = append(results, r.fields)
+	}
+
+	return results, nil
+}
+
+// applyTransforms passes records through transforms in turn. page is the
+// page the records were scraped from, or nil if they weren't.
+func applyTransforms(job *ScrapeJob, transforms []Transform, records []pageRecord, page *SpiderResult) ([]pageRecord, error) {
+	var url string
+	if page != nil {
+		url = page.URL.String()
+	}
+
+	for _, t := range transforms {
+		var transformed = []pageRecord{}
+		for _, r := range records {
+			var pageContext *PageContext
+			if page != nil {
+				pageContext = &PageContext{
+					Scraper: job.config.Name,
+					Result:  page,
+					Node:    r.node,
+				}
+			}
+			result, err := t.Apply(r.fields, pageContext)
+			if err != nil {
+				terr := &TransformError{
+					Scraper:   job.config.Name,
+					Transform: t.Name(),
+					URL:       url,
+					Record:    r.fields,
+					Err:       err,
+				}
+				if job.config.OnTransformError == transformErrorSkip {
+					log.Warn(terr)
+					continue
+				}
+				return nil, terr
+			}
+			for _, fields := range result {
+				transformed = append(transformed, pageRecord{fields, r.node})
+			}
+		}
+		records = transformed
+	}
+
+	return records, nil
 }
 
-func parseFields(config map[string]interface{}, node types.Node) (map[string]interface{}, error) {
+// configHash identifies a scraper configuration together with the source of
+// its transforms, so that changing either causes pages to be scraped again.
+func configHash(config *ConfigScraper, transforms []string) (string, error) {
+	c, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return hashStrings(append([]string{string(c)}, transforms...)...), nil
+}
+
+func hashStrings(values ...string) string {
+	h := sha1.New()
+	for _, v := range values {
+		io.WriteString(h, v)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// parseFields scrapes the fields of a record from node. Fields with a
+// transform are passed through the transform in transforms with that path.
+func parseFields(config map[string]interface{}, node types.Node, transforms map[string]ScriptTransform) (map[string]interface{}, error) {
 	ctx, err := xpath.NewContext(node)
 	if err != nil {
 		return nil, err
@@ -205,6 +663,7 @@ func parseFields(config map[string]interface{}, node types.Node) (map[string]int
 		default:
 			return nil, fmt.Errorf("Unexpected type for value \"%s\"", k)
 		case map[string]interface{}:
+			var value interface{}
 			if _, ok := f["fields"]; ok {
 				fields, ok := f["fields"].(map[string]interface{})
 				if !ok {
@@ -225,37 +684,113 @@ func parseFields(config map[string]interface{}, node types.Node) (map[string]int
 					defer xresult.Free()
 					nextNodes = xresult.NodeList()
 				}
-				value := []map[string]interface{}{}
+				nested := []map[string]interface{}{}
 				for _, n := range nextNodes {
-					parsed, err := parseFields(fields, n)
+					parsed, err := parseFields(fields, n, transforms)
 					if err != nil {
 						return nil, err
 					}
-					value = append(value, parsed)
+					nested = append(nested, parsed)
+				}
+				value = nested
+			} else if _, ok := f["xpath"]; ok {
+				xpathString, ok := f["xpath"].(string)
+				if !ok {
+					return nil, fmt.Errorf("Unexpected type for value \"xpath\". Should be string.")
+				}
+				value, err = findField(ctx, xpathString)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				continue
+			}
+
+			if t, ok := f["transform"]; ok {
+				path, ok := t.(string)
+				if !ok {
+					return nil, fmt.Errorf("Unexpected type for value \"transform\". Should be string.")
+				}
+				value, err = applyFieldTransform(transforms, path, k, value)
+				if err != nil {
+					return nil, err
 				}
-				result[k] = value
 			}
+			result[k] = value
 		case string:
-			xresult, err := ctx.Find(f)
+			value, err := findField(ctx, f)
 			if err != nil {
 				return nil, err
 			}
+			result[k] = value
+		}
+	}
+	return result, nil
+}
 
-			defer xresult.Free()
+// findField returns the text of the node matching an XPath, or the text of
+// every node if it doesn't match exactly one.
+func findField(ctx *xpath.Context, expr string) (interface{}, error) {
+	xresult, err := ctx.Find(expr)
+	if err != nil {
+		return nil, err
+	}
 
-			var sresult string
-			if len(xresult.NodeList()) == 1 {
-				sresult = xresult.NodeList()[0].TextContent()
-				result[k] = sresult
-				continue
-			}
+	defer xresult.Free()
+
+	if len(xresult.NodeList()) == 1 {
+		return xresult.NodeList()[0].TextContent(), nil
+	}
 
-			var ssresult []string = []string{}
-			for _, v := range xresult.NodeList() {
-				ssresult = append(ssresult, v.TextContent())
+	var ssresult []string = []string{}
+	for _, v := range xresult.NodeList() {
+		ssresult = append(ssresult, v.TextContent())
+	}
+	return ssresult, nil
+}
+
+// applyFieldTransform passes the value of a field through a transform.
+// Fields with several values, such as an XPath matching several nodes or
+// nested fields, are transformed element-wise.
+func applyFieldTransform(transforms map[string]ScriptTransform, path string, field string, value interface{}) (interface{}, error) {
+	t, ok := transforms[path]
+	if !ok {
+		return nil, fmt.Errorf("Transform %s for field \"%s\" hasn't been loaded", path, field)
+	}
+
+	apply := func(v interface{}) (interface{}, error) {
+		result, err := t.ApplyValue(v)
+		if err != nil {
+			return nil, &TransformError{
+				Transform: t.Name(),
+				Record:    map[string]interface{}{field: v},
+				Err:       err,
 			}
-			result[k] = ssresult
 		}
+		return result, nil
 	}
-	return result, nil
+
+	var values = []interface{}{}
+	switch v := value.(type) {
+	case []string:
+		for _, s := range v {
+			values = append(values, s)
+		}
+	case []map[string]interface{}:
+		for _, m := range v {
+			values = append(values, m)
+		}
+	default:
+		return apply(value)
+	}
+
+	var results = []interface{}{}
+	for _, v := range values {
+		result, err := apply(v)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
@@ -52,7 +53,7 @@ func TestScraper(t *testing.T) {
 		Scrapers: []*ConfigScraper{
 			&ConfigScraper{
 				Name:    "Test",
-				Output:  "test.jsonl",
+				Output:  &ConfigOutput{Path: "test.jsonl"},
 				Context: "//div",
 				Fields: map[string]interface{}{
 					"title": "./span/text()",
@@ -61,7 +62,7 @@ func TestScraper(t *testing.T) {
 		},
 	}
 
-	err = RunScraper(testDB, rugFile)
+	err = RunScraper(testDB, rugFile, ScrapeOptions{})
 	assert.NoError(t, err)
 
 	b, _ := ioutil.ReadFile("test.jsonl")
@@ -74,17 +75,318 @@ func TestScraper(t *testing.T) {
 
 }
 
-func TestLuaJSON(t *testing.T) {
-	var value = make(map[string]interface{})
-	value["foo"] = 10
-	result, err := ApplyTransform(value, `
+func TestScraperIncremental(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	u, _ := url.Parse("foo.com")
+
+	res := &SpiderResult{
+		URL:      u,
+		Response: `<html><body><span>title1</span></body></html>`,
+	}
+
+	storeResult(testDB, res)
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Scrapers: []*ConfigScraper{
+			&ConfigScraper{
+				Name:   "Test",
+				Output: &ConfigOutput{Path: "test_incremental.jsonl"},
+				Fields: map[string]interface{}{
+					"title": "//span/text()",
+				},
+			},
+		},
+	}
+
+	defer os.Remove("test_incremental.jsonl")
+
+	// Unchanged pages are not scraped again
+	err = RunScraper(testDB, rugFile, ScrapeOptions{})
+	assert.NoError(t, err)
+	err = RunScraper(testDB, rugFile, ScrapeOptions{})
+	assert.NoError(t, err)
+
+	b, _ := ioutil.ReadFile("test_incremental.jsonl")
+	assert.Equal(t, "{\"title\":\"title1\"}\n", string(b))
+
+	// Changed pages are
+	res.Response = `<html><body><span>title2</span></body></html>`
+	storeResult(testDB, res)
+
+	err = RunScraper(testDB, rugFile, ScrapeOptions{})
+	assert.NoError(t, err)
+
+	b, _ = ioutil.ReadFile("test_incremental.jsonl")
+	assert.Equal(t, "{\"title\":\"title1\"}\n{\"title\":\"title2\"}\n", string(b))
+
+	// A full run truncates the output
+	err = RunScraper(testDB, rugFile, ScrapeOptions{Full: true})
+	assert.NoError(t, err)
+
+	b, _ = ioutil.ReadFile("test_incremental.jsonl")
+	assert.Equal(t, "{\"title\":\"title2\"}\n", string(b))
+}
+
+func TestScraperSelect(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	u, _ := url.Parse("foo.com")
+
+	res := &SpiderResult{
+		URL:      u,
+		Response: `<html><body><span>title1</span></body></html>`,
+	}
+
+	storeResult(testDB, res)
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Scrapers: []*ConfigScraper{
+			&ConfigScraper{
+				Name:   "First",
+				Output: &ConfigOutput{Path: "test_first.jsonl"},
+				Fields: map[string]interface{}{
+					"title": "//span/text()",
+				},
+			},
+			&ConfigScraper{
+				Name:   "Second",
+				Output: &ConfigOutput{Path: "test_second.jsonl"},
+				Fields: map[string]interface{}{
+					"title": "//span/text()",
+				},
+			},
+		},
+	}
+
+	defer os.Remove("test_first.jsonl")
+	defer os.Remove("test_second.jsonl")
+
+	err = RunScraper(testDB, rugFile, ScrapeOptions{Scraper: "Second"})
+	assert.NoError(t, err)
+
+	_, err = os.Stat("test_first.jsonl")
+	assert.True(t, os.IsNotExist(err))
+
+	b, _ := ioutil.ReadFile("test_second.jsonl")
+	assert.Equal(t, "{\"title\":\"title1\"}\n", string(b))
+
+	err = RunScraper(testDB, rugFile, ScrapeOptions{Scraper: "Third"})
+	assert.Error(t, err)
+}
+
+func TestScraperTransformError(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	u, _ := url.Parse("foo.com")
+
+	res := &SpiderResult{
+		URL:      u,
+		Response: `<html><body><span>title1</span><span>fail</span></body></html>`,
+	}
+
+	storeResult(testDB, res)
+
+	err = ioutil.WriteFile("test_fail.lua", []byte(`
+		function transform(state)
+			if state["title"] == "fail" then
+				error("bad title")
+			end
+			return state
+		end
+	`), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.Remove("test_fail.lua")
+	defer os.Remove("test_fail.jsonl")
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Scrapers: []*ConfigScraper{
+			&ConfigScraper{
+				Name:    "Test",
+				Output:  &ConfigOutput{Path: "test_fail.jsonl"},
+				Context: "//span",
+				Fields: map[string]interface{}{
+					"title": "./text()",
+				},
+				Transforms: []*ConfigTransform{{Path: "test_fail.lua"}},
+			},
+		},
+	}
+
+	err = RunScraper(testDB, rugFile, ScrapeOptions{})
+	assert.Error(t, err)
+	terr, ok := err.(*TransformError)
+	assert.True(t, ok)
+	assert.Equal(t, "Test", terr.Scraper)
+	assert.Equal(t, "foo.com", terr.URL)
+	assert.Equal(t, "fail", terr.Record["title"])
+	assert.Contains(t, err.Error(), "test_fail.lua:4:")
+
+	rugFile.Scrapers[0].OnTransformError = transformErrorSkip
+	err = RunScraper(testDB, rugFile, ScrapeOptions{})
+	assert.NoError(t, err)
+
+	b, _ := ioutil.ReadFile("test_fail.jsonl")
+	assert.Equal(t, "{\"title\":\"title1\"}\n", string(b))
+}
+
+func TestScraperStatefulTransform(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	for i, p := range []string{"foo.com", "bar.com"} {
+		u, _ := url.Parse(p)
+		storeResult(testDB, &SpiderResult{
+			URL:      u,
+			Response: fmt.Sprintf(`<html><body><span>title%d</span></body></html>`, i),
+		})
+	}
+
+	err = ioutil.WriteFile("test_count.lua", []byte(`
+		function init()
+			count = 0
+		end
+
 		function transform(state)
-			state["foo"] = 20
+			count = count + 1
 			return state
 		end
-	`)
+
+		function finish()
+			return {total = count}
+		end
+	`), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.Remove("test_count.lua")
+	defer os.Remove("test_count.jsonl")
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Scrapers: []*ConfigScraper{
+			&ConfigScraper{
+				Name:   "Test",
+				Output: &ConfigOutput{Path: "test_count.jsonl"},
+				Fields: map[string]interface{}{
+					"title": "//span/text()",
+				},
+				Transforms: []*ConfigTransform{{Path: "test_count.lua"}},
+			},
+		},
+	}
+
+	err = RunScraper(testDB, rugFile, ScrapeOptions{})
+	assert.NoError(t, err)
+
+	b, _ := ioutil.ReadFile("test_count.jsonl")
+	assert.Equal(t, "{\"title\":\"title1\"}\n{\"title\":\"title0\"}\n{\"total\":2}\n", string(b))
+
+	// As the transform defines finish, every page is scraped again, and its
+	// total replaces the last one rather than only counting the new page
+	u, _ := url.Parse("baz.com")
+	storeResult(testDB, &SpiderResult{
+		URL:      u,
+		Response: `<html><body><span>title2</span></body></html>`,
+	})
+
+	err = RunScraper(testDB, rugFile, ScrapeOptions{})
+	assert.NoError(t, err)
+
+	b, _ = ioutil.ReadFile("test_count.jsonl")
+	assert.Equal(t, "{\"title\":\"title1\"}\n{\"title\":\"title2\"}\n{\"title\":\"title0\"}\n{\"total\":3}\n", string(b))
+}
+
+func TestScraperFieldTransforms(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	u, _ := url.Parse("foo.com")
+	storeResult(testDB, &SpiderResult{
+		URL: u,
+		Response: `<html><body>
+			<span>title</span>
+			<a href="/a">a</a><a href="/b">b</a>
+			<div><p>one</p></div><div><p>two</p></div>
+		</body></html>`,
+	})
+
+	err = ioutil.WriteFile("test_upper.lua", []byte(`
+		function transform(value)
+			return string.upper(value)
+		end
+	`), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile("test_item.js", []byte(`
+		function transform(value) {
+			return { text: value.text + "!" };
+		}
+	`), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.Remove("test_upper.lua")
+	defer os.Remove("test_item.js")
+	defer os.Remove("test_fields.jsonl")
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Scrapers: []*ConfigScraper{
+			&ConfigScraper{
+				Name:   "Test",
+				Output: &ConfigOutput{Path: "test_fields.jsonl"},
+				Fields: map[string]interface{}{
+					"title": map[string]interface{}{
+						"xpath":     "//span/text()",
+						"transform": "test_upper.lua",
+					},
+					"links": map[string]interface{}{
+						"xpath":     "//a/@href",
+						"transform": "test_upper.lua",
+					},
+					"items": map[string]interface{}{
+						"context": "//div",
+						"fields": map[string]interface{}{
+							"text": map[string]interface{}{
+								"xpath":     "./p/text()",
+								"transform": "test_upper.lua",
+							},
+						},
+						"transform": "test_item.js",
+					},
+				},
+			},
+		},
+	}
+
+	err = RunScraper(testDB, rugFile, ScrapeOptions{})
 	assert.NoError(t, err)
-	assert.Equal(t, result["foo"], float64(20))
+
+	b, _ := ioutil.ReadFile("test_fields.jsonl")
+	assert.Equal(t, `{"items":[{"text":"ONE!"},{"text":"TWO!"}],"links":["/A","/B"],"title":"TITLE"}`+"\n", string(b))
 }
 
 func TestParseFields(t *testing.T) {
@@ -120,7 +422,7 @@ func TestParseFields(t *testing.T) {
 	doc, err := libxml2.ParseHTMLString(page)
 	assert.NoError(t, err)
 
-	result, err := parseFields(m, doc)
+	result, err := parseFields(m, doc, nil)
 	assert.NoError(t, err)
 
 	containers, _ := result["containers"].([]map[string]interface{})
@@ -130,3 +432,106 @@ func TestParseFields(t *testing.T) {
 	assert.Equal(t, "title1", title1)
 	assert.Equal(t, "title2", title2)
 }
+
+func TestScraperSpiders(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, spider := range []string{"catalog", "blog"} {
+		u, _ := url.Parse("foo.com/" + spider)
+		storeResult(testDB, &SpiderResult{
+			URL:      u,
+			Spider:   spider,
+			Response: fmt.Sprintf(`<html><body><h1>%s</h1></body></html>`, spider),
+		})
+	}
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Options: &ConfigOptions{
+			StoreOptions: &ConfigStoreOptions{
+				Strategy: "memory",
+			},
+		},
+		Scrapers: []*ConfigScraper{
+			&ConfigScraper{
+				Name:    "Blog",
+				Output:  &ConfigOutput{Path: "test_spiders.jsonl"},
+				Spiders: []string{"blog"},
+				Fields: map[string]interface{}{
+					"title": "//h1/text()",
+				},
+			},
+		},
+	}
+	defer os.Remove("test_spiders.jsonl")
+
+	err = RunScraper(testDB, rugFile, ScrapeOptions{})
+	assert.NoError(t, err)
+
+	b, _ := ioutil.ReadFile("test_spiders.jsonl")
+	assert.Equal(t, "{\"title\":\"blog\"}\n", string(b))
+}
+
+type testSink struct {
+	flushed int
+}
+
+func (s *testSink) Write(record map[string]interface{}) error {
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return nil
+}
+
+type testFlushSink struct {
+	testSink
+}
+
+func (s *testFlushSink) Flush() error {
+	s.flushed++
+	return nil
+}
+
+func TestScrapedHashesStoredWhenDurable(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	scrape := func(job *ScrapeJob, n int) {
+		for i := 0; i < n; i++ {
+			putScrapedHash(job.scraped, job.config.Name, fmt.Sprintf("http://foo.com/%d", i), "hash")
+			job.unstored++
+			assert.NoError(t, job.storeScraped(testDB, false))
+		}
+	}
+	stored := func(scraper string, i int) bool {
+		h, err := getScrapedHash(testDB, scraper, fmt.Sprintf("http://foo.com/%d", i))
+		assert.NoError(t, err)
+		return h != ""
+	}
+
+	// Pages are marked as scraped each time the output is flushed
+	sink := &testFlushSink{}
+	job := &ScrapeJob{config: &ConfigScraper{Name: "Flushed"}, output: sink, scraped: new(leveldb.Batch)}
+	scrape(job, scrapedBatchSize+1)
+	assert.Equal(t, 1, sink.flushed)
+	assert.True(t, stored("Flushed", scrapedBatchSize-1))
+	assert.False(t, stored("Flushed", scrapedBatchSize))
+	assert.NoError(t, job.storeScraped(testDB, true))
+	assert.True(t, stored("Flushed", scrapedBatchSize))
+
+	// Outputs which can't be flushed, such as parquet, only once they're
+	// closed
+	job = &ScrapeJob{config: &ConfigScraper{Name: "Closed"}, output: &testSink{}, scraped: new(leveldb.Batch)}
+	scrape(job, scrapedBatchSize+1)
+	assert.False(t, stored("Closed", 0))
+	assert.NoError(t, job.storeScraped(testDB, true))
+	assert.True(t, stored("Closed", 0))
+	assert.True(t, stored("Closed", scrapedBatchSize))
+}
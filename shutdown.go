@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+)
+
+// defaultShutdownTimeout is how long the spider waits for requests in flight
+// once it has been told to stop.
+const defaultShutdownTimeout = 30 * time.Second
+
+// errStopped is returned by the spider and scrapers when they were stopped
+// by a signal before they finished.
+var errStopped = errors.New("Stopped")
+
+// stopOnSignal returns a channel which is closed on the first SIGINT or
+// SIGTERM, so that the run can stop cleanly. A second signal exits straight
+// away.
+func stopOnSignal() <-chan struct{} {
+	var stop = make(chan struct{})
+	var signals = make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Info("Stopping.. press Ctrl-C again to quit straight away")
+		close(stop)
+		<-signals
+		log.Warn("Quitting without waiting")
+		os.Exit(130)
+	}()
+	return stop
+}
+
+// stopped reports whether stop has been closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Checkpoint records where a crawl was stopped, so that the next run can say
+// that it is resuming.
+type Checkpoint struct {
+	Time   time.Time `json:"time"`
+	Spider string    `json:"spider"`
+	// Fetched is how many pages the spider had stored
+	Fetched int `json:"fetched"`
+	// Abandoned are the URLs which were still in flight when the spider gave
+	// up waiting for them. They are still queued, and are fetched again.
+	Abandoned []string `json:"abandoned"`
+}
+
+var checkpointKey = []byte("checkpoint")
+
+func storeCheckpoint(db *leveldb.DB, c *Checkpoint) error {
+	var redacted = *c
+	redacted.Abandoned = []string{}
+	for _, u := range c.Abandoned {
+		redacted.Abandoned = append(redacted.Abandoned, secrets.Redact(u))
+	}
+	j, err := json.Marshal(&redacted)
+	if err != nil {
+		return err
+	}
+	return db.Put(checkpointKey, j, nil)
+}
+
+// getCheckpoint returns the checkpoint of the last crawl, or nil if it
+// finished.
+func getCheckpoint(db *leveldb.DB) (*Checkpoint, error) {
+	v, err := db.Get(checkpointKey, nil)
+	if err == lerrors.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c = &Checkpoint{}
+	err = json.Unmarshal(v, c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func clearCheckpoint(db *leveldb.DB) error {
+	return db.Delete(checkpointKey, nil)
+}
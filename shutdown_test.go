@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestSpiderShutdown(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	var stop = make(chan struct{})
+	var requests = make(chan string, 100)
+	var release = make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.String()
+		if r.URL.Query().Get("n") == "0" {
+			// Stop while the first request is in flight
+			close(stop)
+			<-release
+		}
+		w.WriteHeader(200)
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		w.Write([]byte(fmt.Sprintf(`<a href="/?n=%d">next</a>`, n+1)))
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Options: &ConfigOptions{
+			SpiderOptions: &ConfigSpiderOptions{
+				Concurrency: 1,
+				MaxResults:  3,
+			},
+			StoreOptions: &ConfigStoreOptions{
+				Strategy: "memory",
+			},
+		},
+		Spider: &ConfigSpider{
+			URLs:  []string{ts.URL + "/?n=0"},
+			Links: []*ConfigLinkRule{{XPath: "//a/@href"}},
+		},
+	}
+
+	go func() {
+		<-stop
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	err = RunSpider(testDB, rugFile, CrawlOptions{Stop: stop, ShutdownTimeout: time.Second})
+	assert.Equal(t, errStopped, err)
+
+	// The request in flight was waited for, and its link queued
+	assert.Equal(t, "/?n=0", <-requests)
+	assert.Len(t, requests, 0)
+	_, err = getStoredResult(testDB, "", ts.URL+"/?n=0")
+	assert.NoError(t, err)
+
+	checkpoint, err := getCheckpoint(testDB)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, checkpoint.Fetched)
+	assert.Equal(t, []string{}, checkpoint.Abandoned)
+
+	err = RunSpider(testDB, rugFile, CrawlOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "/?n=1", <-requests)
+	assert.Equal(t, "/?n=2", <-requests)
+	checkpoint, err = getCheckpoint(testDB)
+	assert.NoError(t, err)
+	assert.Nil(t, checkpoint)
+}
+
+func TestSpiderShutdownTimeout(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	var stop = make(chan struct{})
+	var release = make(chan struct{})
+	var requested = 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		requested++
+		if requested == 1 {
+			close(stop)
+			<-release
+		}
+		w.WriteHeader(200)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+	defer close(release)
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Options: &ConfigOptions{
+			SpiderOptions: &ConfigSpiderOptions{Concurrency: 1},
+			StoreOptions:  &ConfigStoreOptions{Strategy: "memory"},
+		},
+		Spider: &ConfigSpider{URLs: []string{ts.URL + "/slow"}},
+	}
+
+	err = RunSpider(testDB, rugFile, CrawlOptions{Stop: stop, ShutdownTimeout: 10 * time.Millisecond})
+	assert.Equal(t, errStopped, err)
+
+	checkpoint, err := getCheckpoint(testDB)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, checkpoint.Fetched)
+	assert.Equal(t, []string{ts.URL + "/slow"}, checkpoint.Abandoned)
+
+	// The abandoned request is still queued
+	counts, err := getCrawlCounts(testDB, "")
+	assert.NoError(t, err)
+	assert.Equal(t, CrawlCounts{InFlight: 1}, counts)
+	f, err := openFrontier(testDB, "", orderBFS)
+	assert.NoError(t, err)
+	assert.Equal(t, CrawlCounts{Queued: 1}, f.Counts())
+	next, err := f.Next(1, nil)
+	assert.NoError(t, err)
+	assert.Len(t, next, 1)
+}
+
+func TestScraperShutdown(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	u, _ := url.Parse("foo.com")
+	storeResult(testDB, &SpiderResult{URL: u, Response: `<html><body><h1>title</h1></body></html>`})
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Options: &ConfigOptions{
+			StoreOptions: &ConfigStoreOptions{Strategy: "memory"},
+		},
+		Scrapers: []*ConfigScraper{
+			&ConfigScraper{
+				Name:   "Test",
+				Output: &ConfigOutput{Path: "test_shutdown.jsonl"},
+				Fields: map[string]interface{}{"title": "//h1/text()"},
+				Transforms: []*ConfigTransform{
+					{Lua: `function transform (state) return state end function finish () return { total = 1 } end`},
+				},
+			},
+		},
+	}
+	defer os.Remove("test_shutdown.jsonl")
+
+	var stop = make(chan struct{})
+	close(stop)
+	err = RunScraper(testDB, rugFile, ScrapeOptions{Stop: stop})
+	assert.Equal(t, errStopped, err)
+	// An interrupted run doesn't call finish
+	b, _ := ioutil.ReadFile("test_shutdown.jsonl")
+	assert.Equal(t, "", string(b))
+
+	// The next run scrapes the remaining pages
+	err = RunScraper(testDB, rugFile, ScrapeOptions{})
+	assert.NoError(t, err)
+	b, _ = ioutil.ReadFile("test_shutdown.jsonl")
+	assert.Equal(t, "{\"title\":\"title\"}\n{\"total\":1}\n", string(b))
+}
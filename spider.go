@@ -2,41 +2,124 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
+	"time"
 
 	libxml2 "github.com/lestrrat/go-libxml2"
 	"github.com/lestrrat/go-libxml2/xpath"
 	log "github.com/sirupsen/logrus"
 	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
 	"golang.org/x/net/html"
 )
 
 type spiderManager struct {
+	name     string
 	config   *ConfigSpider
-	inFlight int
+	links    []*linkRule
+	frontier *frontier
+	// pending are the requests in flight, by their frontier key
+	pending  map[string]*SpiderRequest
 	conc     int
+	max      int
+	progress *crawlProgress
 	c        chan *SpiderResult
 }
 
-func RunSpider(db *leveldb.DB, rugFile *RugFile) error {
-	var maxResults = rugFile.Options.SpiderOptions.MaxResults
+// CrawlOptions are the options of a run of the spiders.
+type CrawlOptions struct {
+	// Spider runs only the spider with this name, if set
+	Spider string
+	// Stop stops the spiders when it is closed. Requests in flight are
+	// waited for until ShutdownTimeout, and a checkpoint is stored.
+	Stop            <-chan struct{}
+	ShutdownTimeout time.Duration
+}
 
-	m := &spiderManager{
-		inFlight: 0,
-		config:   rugFile.Spider,
-		conc:     rugFile.Options.SpiderOptions.Concurrency,
-		c:        make(chan *SpiderResult, rugFile.Options.SpiderOptions.Concurrency),
+// RunSpider runs each of the configured spiders in turn, or only the one
+// named in options.
+func RunSpider(db *leveldb.DB, rugFile *RugFile, options CrawlOptions) error {
+	var spiders = rugFile.allSpiders()
+	if options.Spider != "" {
+		spiders = nil
+		for _, s := range rugFile.allSpiders() {
+			if s.Name == options.Spider {
+				spiders = append(spiders, s)
+			}
+		}
+		if len(spiders) == 0 {
+			return fmt.Errorf("Can't find a spider named \"%s\"", options.Spider)
+		}
 	}
 
-	count, err := getStoredResultCount(db)
+	checkpoint, err := getCheckpoint(db)
 	if err != nil {
 		return err
 	}
 
-	if maxResults != 0 && count >= maxResults {
+	progress := newCrawlProgress()
+	for _, s := range spiders {
+		if stopped(options.Stop) {
+			return errStopped
+		}
+		if s.Name != "" {
+			log.Infof("Starting spider %s..", s.Name)
+		}
+		if checkpoint != nil && checkpoint.Spider == s.Name {
+			log.Infof("Resuming the crawl stopped at %s, with %d pages fetched",
+				checkpoint.Time.Format(time.RFC1123), checkpoint.Fetched)
+			if len(checkpoint.Abandoned) > 0 {
+				log.Infof("%d requests which were in flight will be made again", len(checkpoint.Abandoned))
+			}
+		}
+
+		err := runSpider(db, s, s.options(rugFile.Options.SpiderOptions), options, progress)
+		if err == errStopped {
+			progress.summary()
+		}
+		if err != nil {
+			return err
+		}
+
+		if checkpoint != nil && checkpoint.Spider == s.Name {
+			err = clearCheckpoint(db)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	progress.summary()
+	return nil
+}
+
+func runSpider(db *leveldb.DB, config *ConfigSpider, options *ConfigSpiderOptions, crawl CrawlOptions, progress *crawlProgress) error {
+	links, err := compileLinkRules(config.Links)
+	if err != nil {
+		return err
+	}
+
+	f, err := openFrontier(db, config.Name, options.Order)
+	if err != nil {
+		return err
+	}
+
+	m := &spiderManager{
+		name:     config.Name,
+		config:   config,
+		links:    links,
+		frontier: f,
+		pending:  map[string]*SpiderRequest{},
+		conc:     options.Concurrency,
+		max:      options.MaxResults,
+		progress: progress,
+		c:        make(chan *SpiderResult, options.Concurrency),
+	}
+
+	if m.max != 0 && f.Counts().Fetched() >= m.max {
 		log.Info("..Done!")
 		return nil
 	}
@@ -48,115 +131,176 @@ func RunSpider(db *leveldb.DB, rugFile *RugFile) error {
 			return err
 		}
 		req := &SpiderRequest{
-			URL: u,
+			URL:    u,
+			Spider: m.name,
 		}
-		err = storeRequest(db, req)
+		err = m.frontier.Push(req)
 		if err != nil {
 			return err
 		}
 	}
 
-	var done bool
-	done, err = makeRequests(db, m)
-	if err != nil {
-		return err
-	}
-	if done {
-		log.Info("..Done!")
-		return nil
-	}
+	progress.begin(m.name, f, m.max)
+	defer progress.end()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
 
 	for {
+		done, err := makeRequests(db, m)
+		if err != nil {
+			return err
+		}
+		if done {
+			log.Info("..Done!")
+			return nil
+		}
+
 		select {
 		case r := <-m.c:
-			err = storeResult(db, r)
-			if err != nil {
-				return err
-			}
-			err = db.Delete([]byte("req-"+r.URL.String()), nil)
+			err = m.storeResult(db, r)
 			if err != nil {
 				return err
 			}
-			for _, u := range r.Children {
-				req := &SpiderRequest{
-					URL: u,
-				}
-				err := storeRequest(db, req)
-				if err != nil {
-					return err
-				}
-			}
-			m.inFlight--
+		case now := <-ticker.C:
+			progress.tick(now)
+		case <-crawl.Stop:
+			return m.shutdown(db, crawl.ShutdownTimeout)
+		}
+	}
+}
 
-			c, err := getStoredResultCount(db)
-			if err != nil {
-				return err
-			}
+// storeResult stores the result of a request, and queues the requests for
+// its children. The result, the state of its URL and the children are stored
+// in one batch, so a crawl which stops between them doesn't lose children.
+func (m *spiderManager) storeResult(db *leveldb.DB, r *SpiderResult) error {
+	batch := new(leveldb.Batch)
+	err := putResult(batch, r)
+	if err != nil {
+		return err
+	}
+	err = m.frontier.done(batch, r.request, resultState(r))
+	if err != nil {
+		return err
+	}
+	var seen = map[string]bool{}
+	for _, req := range r.requests {
+		err = m.frontier.push(batch, req, seen)
+		if err != nil {
+			return err
+		}
+	}
+	err = db.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+	delete(m.pending, string(r.request.key))
+	m.progress.add(r)
+	return nil
+}
 
-			if maxResults > 0 && c >= maxResults {
-				log.Info("...Done!")
-				return nil
-			}
+// shutdown stops making requests, and waits for those in flight until the
+// timeout. Requests which are still in flight then stay queued, and a
+// checkpoint is stored so that the next run can resume the crawl.
+func (m *spiderManager) shutdown(db *leveldb.DB, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	if len(m.pending) > 0 {
+		log.Infof("Waiting up to %s for %d requests in flight..", timeout, len(m.pending))
+	}
 
-			var done bool
-			done, err = makeRequests(db, m)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+wait:
+	for len(m.pending) > 0 {
+		select {
+		case r := <-m.c:
+			err := m.storeResult(db, r)
 			if err != nil {
 				return err
 			}
-			if done {
-				log.Info("..Done!")
-				return nil
-			}
+		case <-timer.C:
+			log.Warnf("Gave up waiting for %d requests, they will be made again when the crawl resumes", len(m.pending))
+			break wait
 		}
 	}
+
+	var checkpoint = &Checkpoint{
+		Time:      time.Now(),
+		Spider:    m.name,
+		Fetched:   m.frontier.Counts().Fetched(),
+		Abandoned: []string{},
+	}
+	for _, r := range m.pending {
+		checkpoint.Abandoned = append(checkpoint.Abandoned, r.URL.String())
+	}
+	sort.Strings(checkpoint.Abandoned)
+	err := storeCheckpoint(db, checkpoint)
+	if err != nil {
+		return err
+	}
+	return errStopped
 }
 
+// makeRequests starts as many requests as concurrency allows, but no more
+// than the max left to fetch. It reports whether the spider is done, which is
+// when no requests are in flight and no more can be made.
 func makeRequests(db *leveldb.DB, m *spiderManager) (done bool, err error) {
-	iter := db.NewIterator(util.BytesPrefix([]byte("req-")), nil)
-	defer iter.Release()
-	for m.inFlight < m.conc {
-		if !iter.Next() {
+	for {
+		counts := m.frontier.Counts()
+		n := m.conc - counts.InFlight
+		if m.max > 0 && m.max-counts.Fetched()-counts.InFlight < n {
+			n = m.max - counts.Fetched() - counts.InFlight
+		}
+		if n <= 0 {
 			break
 		}
 
-		v := iter.Value()
-		err := iter.Error()
+		requests, err := m.frontier.Next(n, m.pending)
 		if err != nil {
 			return false, err
 		}
+		if len(requests) == 0 {
+			break
+		}
 
-		var buffer = bytes.NewBuffer(v)
-		var r = &SpiderRequest{}
-		d := gob.NewDecoder(buffer)
-		err = d.Decode(r)
-		if err != nil {
-			return false, err
+		var start = []*SpiderRequest{}
+		for _, r := range requests {
+			visited, err := hasResult(db, m.name, r.URL)
+			if err != nil {
+				return false, err
+			}
+			if visited {
+				log.Debugf("Found cached page %s.. skipping", r.URL)
+				err = m.frontier.Done(r, stateSkipped)
+				if err != nil {
+					return false, err
+				}
+				continue
+			}
+			start = append(start, r)
 		}
 
-		visited, err := hasResult(db, r.URL)
+		err = m.frontier.Start(start...)
 		if err != nil {
 			return false, err
 		}
-		if visited {
-			log.Debugf("Found cached page %s.. skipping", r.URL)
-			continue
+		for _, r := range start {
+			m.pending[string(r.key)] = r
+			go makeRequest(m, r, m.c)
 		}
-		go makeRequest(m, r, m.c)
-		m.inFlight++
 	}
 
-	if m.inFlight == 0 {
-		return true, nil
-	}
-
-	return false, nil
+	return m.frontier.Counts().InFlight == 0, nil
 }
 
 func makeRequest(m *spiderManager, req *SpiderRequest, c chan *SpiderResult) {
 	resp, err := http.Get(req.URL.String())
 	var result = &SpiderResult{
 		URL:      req.URL,
+		Spider:   m.name,
 		Children: []*url.URL{},
+		request:  req,
 	}
 
 	log.Debugf("Making request to %s", req.URL.String())
@@ -168,6 +312,9 @@ func makeRequest(m *spiderManager, req *SpiderRequest, c chan *SpiderResult) {
 		return
 	}
 
+	result.StatusCode = resp.StatusCode
+	result.Header = resp.Header
+
 	if resp.StatusCode >= 400 {
 		result.Error = http.StatusText(resp.StatusCode)
 		log.Errorf("%s %s", req.URL, result.Error)
@@ -195,6 +342,12 @@ func makeRequest(m *spiderManager, req *SpiderRequest, c chan *SpiderResult) {
 
 	result.Response = string(buffer.Bytes())
 
+	if rule := m.rule(req.Rule); rule != nil && !rule.follows() {
+		log.Debugf("Not following links of %s, found by rule %s", req.URL, req.Rule)
+		c <- result
+		return
+	}
+
 	doc, err := libxml2.ParseHTMLReader(buffer)
 	if err != nil {
 		result.Error = err.Error()
@@ -214,12 +367,33 @@ func makeRequest(m *spiderManager, req *SpiderRequest, c chan *SpiderResult) {
 
 	defer ctx.Free()
 
-	for _, l := range m.config.LinksXPATH {
-		log.Debugf("Trying XPath link %s", l)
-		xpResult, err := ctx.Find(l)
+	if m.config.TestXPATH != "" {
+		xpTest, err := ctx.Find(m.config.TestXPATH)
+		if err != nil {
+			log.Errorf("%s %s %s", req.URL, err, m.config.TestXPATH)
+			c <- result
+			return
+		}
+
+		defer xpTest.Free()
+
+		if len(xpTest.NodeList()) == 0 {
+			log.Debugf("Not following links of %s, which doesn't match the test", req.URL)
+			c <- result
+			return
+		}
+	}
+
+	var found = map[string]bool{}
+	for _, rule := range m.links {
+		if rule.MaxDepth > 0 && req.Depth+1 > rule.MaxDepth {
+			continue
+		}
+		log.Debugf("Trying XPath link %s", rule.XPath)
+		xpResult, err := ctx.Find(rule.XPath)
 		defer xpResult.Free()
 		if err != nil {
-			log.Errorf("%s %s %s", req.URL, err, l)
+			log.Errorf("%s %s %s", req.URL, err, rule.XPath)
 			continue
 		}
 		for _, i := range xpResult.NodeList() {
@@ -232,9 +406,102 @@ func makeRequest(m *spiderManager, req *SpiderRequest, c chan *SpiderResult) {
 			if !url.IsAbs() {
 				url = req.URL.ResolveReference(url)
 			}
+			if found[url.String()] || !rule.matches(url) {
+				continue
+			}
+			found[url.String()] = true
 			result.Children = append(result.Children, url)
+			result.requests = append(result.requests, &SpiderRequest{
+				URL:      url,
+				Spider:   m.name,
+				Rule:     rule.Name,
+				Depth:    req.Depth + 1,
+				Priority: rule.Priority,
+			})
 		}
 	}
 
 	c <- result
 }
+
+// UnmarshalJSON accepts either the XPath of a link rule, or an object.
+func (c *ConfigLinkRule) UnmarshalJSON(data []byte) error {
+	var xpath string
+	if err := json.Unmarshal(data, &xpath); err == nil {
+		c.XPath = xpath
+		return nil
+	}
+
+	type configLinkRule ConfigLinkRule
+	return json.Unmarshal(data, (*configLinkRule)(c))
+}
+
+// follows reports whether the links of pages found by the rule are followed.
+func (c *ConfigLinkRule) follows() bool {
+	return c.Follow == nil || *c.Follow
+}
+
+// linkRule is a link rule with its include and exclude patterns compiled.
+type linkRule struct {
+	*ConfigLinkRule
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func compileLinkRules(configs []*ConfigLinkRule) ([]*linkRule, error) {
+	var rules = []*linkRule{}
+	for _, config := range configs {
+		rule := &linkRule{ConfigLinkRule: config}
+		for _, pattern := range config.Include {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid include pattern %s in link rule %s: %s", pattern, config.Name, err)
+			}
+			rule.include = append(rule.include, re)
+		}
+		for _, pattern := range config.Exclude {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid exclude pattern %s in link rule %s: %s", pattern, config.Name, err)
+			}
+			rule.exclude = append(rule.exclude, re)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// rule returns the link rule with a name, or nil for the start URLs and rules
+// without a name.
+func (m *spiderManager) rule(name string) *linkRule {
+	if name == "" {
+		return nil
+	}
+	for _, rule := range m.links {
+		if rule.Name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+// matches reports whether a link found by the rule should be followed. Links
+// must match one of the include patterns, if there are any, and none of the
+// exclude patterns.
+func (rule *linkRule) matches(u *url.URL) bool {
+	s := u.String()
+	for _, re := range rule.exclude {
+		if re.MatchString(s) {
+			return false
+		}
+	}
+	if len(rule.include) == 0 {
+		return true
+	}
+	for _, re := range rule.include {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -53,12 +53,12 @@ func TestRunSpiderSunnyCase(t *testing.T) {
 			},
 		},
 		Spider: &ConfigSpider{
-			URLs:       []string{url},
-			LinksXPATH: []string{"//a/@href"},
+			URLs:  []string{url},
+			Links: []*ConfigLinkRule{{XPath: "//a/@href"}},
 		},
 	}
 
-	err = RunSpider(testDB, rugFile)
+	err = RunSpider(testDB, rugFile, CrawlOptions{})
 	assert.NoError(t, err)
 
 	for i, v := range urls {
@@ -101,15 +101,15 @@ func TestRunSpiderServerError(t *testing.T) {
 			},
 		},
 		Spider: &ConfigSpider{
-			URLs:       []string{url},
-			LinksXPATH: []string{"//a/@href"},
+			URLs:  []string{url},
+			Links: []*ConfigLinkRule{{XPath: "//a/@href"}},
 		},
 	}
 
-	err = RunSpider(testDB, rugFile)
+	err = RunSpider(testDB, rugFile, CrawlOptions{})
 	assert.NoError(t, err)
 
-	r, err := getStoredResult(testDB, url)
+	r, err := getStoredResult(testDB, "", url)
 	assert.NoError(t, err)
 
 	assert.Equal(t, http.StatusText(500), r.Error)
@@ -142,15 +142,210 @@ func TestRunSpiderMalformed(t *testing.T) {
 			},
 		},
 		Spider: &ConfigSpider{
-			URLs:       []string{url},
-			LinksXPATH: []string{"//span/text()"},
+			URLs:  []string{url},
+			Links: []*ConfigLinkRule{{XPath: "//span/text()"}},
 		},
 	}
 
-	err = RunSpider(testDB, rugFile)
+	err = RunSpider(testDB, rugFile, CrawlOptions{})
 	assert.NoError(t, err)
 
-	r, err := getStoredResult(testDB, url)
+	r, err := getStoredResult(testDB, "", url)
 	assert.NoError(t, err)
 	assert.Equal(t, r.Response, "<html><head></head><body><span>hello</span></body></html>")
 }
+
+func TestRunNamedSpiders(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		w.Write([]byte(fmt.Sprintf(`<a class="next" href="%s?n=%d">next</a>`, r.URL.Path, n+1)))
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	one := 1
+	rugFile := &RugFile{
+		Name: "Test",
+		Options: &ConfigOptions{
+			SpiderOptions: &ConfigSpiderOptions{
+				Concurrency: 2,
+				MaxResults:  3,
+			},
+			StoreOptions: &ConfigStoreOptions{
+				Strategy: "memory",
+			},
+		},
+		Spiders: []*ConfigSpider{
+			&ConfigSpider{
+				Name:  "catalog",
+				URLs:  []string{ts.URL + "/catalog"},
+				Links: []*ConfigLinkRule{{XPath: "//a/@href"}},
+			},
+			&ConfigSpider{
+				Name:    "blog",
+				URLs:    []string{ts.URL + "/blog"},
+				Links:   []*ConfigLinkRule{{XPath: "//a/@href"}},
+				Options: &ConfigSpiderOverrides{MaxResults: &one},
+			},
+		},
+	}
+
+	err = RunSpider(testDB, rugFile, CrawlOptions{Spider: "blog"})
+	assert.NoError(t, err)
+	count, err := getStoredResultCount(testDB, "blog")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = getStoredResultCount(testDB, "catalog")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	err = RunSpider(testDB, rugFile, CrawlOptions{})
+	assert.NoError(t, err)
+	count, err = getStoredResultCount(testDB, "catalog")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	r, err := getStoredResult(testDB, "blog", ts.URL+"/blog")
+	assert.NoError(t, err)
+	assert.Equal(t, "blog", r.Spider)
+	r, err = getStoredResult(testDB, "catalog", ts.URL+"/catalog")
+	assert.NoError(t, err)
+	assert.Equal(t, "catalog", r.Spider)
+	_, err = getStoredResult(testDB, "", ts.URL+"/catalog")
+	assert.Error(t, err)
+
+	err = RunSpider(testDB, rugFile, CrawlOptions{Spider: "missing"})
+	assert.Error(t, err)
+}
+
+func TestSpiderFlagArgs(t *testing.T) {
+	assert.Equal(t, []string{"rugburn", "run", "--spiders"}, spiderFlagArgs([]string{"rugburn", "run", "--spider"}))
+	assert.Equal(t, []string{"rugburn", "run", "--spiders", "--full"}, spiderFlagArgs([]string{"rugburn", "run", "--spider", "--full"}))
+	assert.Equal(t, []string{"rugburn", "run", "--spider", "blog"}, spiderFlagArgs([]string{"rugburn", "run", "--spider", "blog"}))
+}
+
+func TestRunSpiderLinkRules(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	var requested = map[string]bool{}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		requested[r.URL.String()] = true
+		w.WriteHeader(200)
+		n, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		w.Write([]byte(fmt.Sprintf(`
+			<a class="next" href="/list?page=%d">next</a>
+			<a class="item" href="/item/%d">item</a>
+			<a class="item" href="/item/%d?print=1">print</a>
+			<a class="more" href="/more/%d">more</a>
+		`, n+1, n, n, n)))
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	no := false
+	rugFile := &RugFile{
+		Name: "Test",
+		Options: &ConfigOptions{
+			SpiderOptions: &ConfigSpiderOptions{
+				Concurrency: 1,
+			},
+			StoreOptions: &ConfigStoreOptions{
+				Strategy: "memory",
+			},
+		},
+		Spider: &ConfigSpider{
+			URLs: []string{ts.URL + "/list?page=0"},
+			Links: []*ConfigLinkRule{
+				{Name: "pages", XPath: "//a[@class='next']/@href", MaxDepth: 3},
+				{Name: "items", XPath: "//a[@class='item']/@href", Follow: &no, Exclude: []string{`print=`}, Priority: 5},
+				{XPath: "//a[@class='more']/@href", Include: []string{`/more/0$`}, MaxDepth: 1},
+			},
+		},
+	}
+
+	err = RunSpider(testDB, rugFile, CrawlOptions{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]bool{
+		"/list?page=0": true,
+		"/list?page=1": true,
+		"/list?page=2": true,
+		"/list?page=3": true,
+		"/item/0":      true,
+		"/item/1":      true,
+		"/item/2":      true,
+		"/item/3":      true,
+		"/more/0":      true,
+	}, requested)
+
+	r, err := getStoredResult(testDB, "", ts.URL+"/list?page=0")
+	assert.NoError(t, err)
+	assert.Len(t, r.Children, 3)
+}
+
+func TestRunSpiderTest(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	var requested = map[string]bool{}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		requested[r.URL.String()] = true
+		w.WriteHeader(200)
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<div class="list"><a href="/a">a</a><a href="/b">b</a></div>`))
+		case "/a":
+			w.Write([]byte(`<div class="list"><a href="/c">c</a></div>`))
+		default:
+			w.Write([]byte(`<div><a href="/d">d</a></div>`))
+		}
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Options: &ConfigOptions{
+			SpiderOptions: &ConfigSpiderOptions{
+				Concurrency: 1,
+			},
+			StoreOptions: &ConfigStoreOptions{
+				Strategy: "memory",
+			},
+		},
+		Spider: &ConfigSpider{
+			URLs:      []string{ts.URL + "/"},
+			TestXPATH: "//div[@class='list']",
+			Links:     []*ConfigLinkRule{{XPath: "//a/@href"}},
+		},
+	}
+
+	err = RunSpider(testDB, rugFile, CrawlOptions{})
+	assert.NoError(t, err)
+
+	// The links of /b and /c aren't followed, as they don't match the test
+	assert.Equal(t, map[string]bool{
+		"/":  true,
+		"/a": true,
+		"/b": true,
+		"/c": true,
+	}, requested)
+
+	r, err := getStoredResult(testDB, "", ts.URL+"/b")
+	assert.NoError(t, err)
+	assert.Empty(t, r.Children)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The crawl states of a URL. URLs are queued when they are found, in flight
+// while they are fetched, and then done, or failed if the request failed.
+// URLs which aren't fetched, because they aren't http or https or their page
+// was already stored, are skipped.
+const stateQueued = "queued"
+const stateInFlight = "inflight"
+const stateDone = "done"
+const stateFailed = "failed"
+const stateSkipped = "skipped"
+
+// CrawlCounts are how many URLs of a spider are in each crawl state.
+type CrawlCounts struct {
+	Queued   int `json:"queued"`
+	InFlight int `json:"inFlight"`
+	Done     int `json:"done"`
+	Failed   int `json:"failed"`
+	Skipped  int `json:"skipped"`
+}
+
+// Fetched is how many pages the spider has fetched, including those which
+// failed. This is what the max option limits.
+func (c CrawlCounts) Fetched() int {
+	return c.Done + c.Failed
+}
+
+func (c *CrawlCounts) add(state string, n int) {
+	switch state {
+	case stateQueued:
+		c.Queued += n
+	case stateInFlight:
+		c.InFlight += n
+	case stateDone:
+		c.Done += n
+	case stateFailed:
+		c.Failed += n
+	case stateSkipped:
+		c.Skipped += n
+	}
+}
+
+// crawlState is the crawl state of each URL of a spider, and the counts of
+// URLs in each state. The counts are written in the same batch as every
+// change of state, so they always agree with the states in the store. Only
+// one crawlState of a spider may change states at a time.
+type crawlState struct {
+	db     *leveldb.DB
+	spider string
+	counts CrawlCounts
+}
+
+func statePrefix(spider string) []byte {
+	return []byte("sta-" + spider + "|")
+}
+
+func stateKey(spider string, u *url.URL) []byte {
+	return append(statePrefix(spider), secrets.Redact(u.String())...)
+}
+
+func stateCountsKey(spider string) []byte {
+	return []byte("cnt-" + spider)
+}
+
+// openCrawlState reads the crawl state of a spider. The states of a store
+// written before crawl states existed are worked out from its results and
+// queue.
+func openCrawlState(db *leveldb.DB, spider string) (*crawlState, error) {
+	s := &crawlState{db: db, spider: spider}
+	v, err := db.Get(stateCountsKey(spider), nil)
+	if err == lerrors.ErrNotFound {
+		return s, s.migrate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(v, &s.counts)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// get returns the state of a URL, or an empty string if it hasn't been found.
+func (s *crawlState) get(u *url.URL) (string, error) {
+	v, err := s.db.Get(stateKey(s.spider, u), nil)
+	if err == lerrors.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(v), nil
+}
+
+// set changes the state of a URL in a batch, along with the counts. The
+// batch must be written before the state of the URL is read again.
+func (s *crawlState) set(batch *leveldb.Batch, u *url.URL, from string, to string) error {
+	if from == to {
+		return nil
+	}
+	s.put(batch, u, from, to)
+	return s.putCounts(batch)
+}
+
+func (s *crawlState) put(batch *leveldb.Batch, u *url.URL, from string, to string) {
+	s.counts.add(from, -1)
+	s.counts.add(to, 1)
+	batch.Put(stateKey(s.spider, u), []byte(to))
+}
+
+func (s *crawlState) putCounts(batch *leveldb.Batch) error {
+	j, err := json.Marshal(&s.counts)
+	if err != nil {
+		return err
+	}
+	batch.Put(stateCountsKey(s.spider), j)
+	return nil
+}
+
+// requeue queues the URLs which were in flight when the last run stopped
+// again. Their requests are still in the frontier.
+func (s *crawlState) requeue() error {
+	if s.counts.InFlight == 0 {
+		return nil
+	}
+	iter := s.db.NewIterator(util.BytesPrefix(statePrefix(s.spider)), nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		if string(iter.Value()) != stateInFlight {
+			continue
+		}
+		batch.Put(append([]byte{}, iter.Key()...), []byte(stateQueued))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	s.counts.Queued += s.counts.InFlight
+	s.counts.InFlight = 0
+	err := s.putCounts(batch)
+	if err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+// migrate sets the states of the URLs of a store written before crawl
+// states existed. Stored pages are done or failed, and requests in the
+// frontier are queued, unless their page is stored. The counts are written
+// last, so a migration which is interrupted is started again.
+func (s *crawlState) migrate() error {
+	batch := new(leveldb.Batch)
+	var flush = func() error {
+		if batch.Len() < frontierBatchSize {
+			return nil
+		}
+		err := s.db.Write(batch, nil)
+		batch.Reset()
+		return err
+	}
+
+	var states = map[string]bool{}
+	iter := s.db.NewIterator(util.BytesPrefix([]byte("res-"+spiderKey(s.spider, ""))), nil)
+	for iter.Next() {
+		r, err := decodeResult(iter.Value())
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		if r.Spider != s.spider {
+			// A page of a named spider, under the prefix of the unnamed one
+			continue
+		}
+		r.URL = secrets.ExpandURL(r.URL)
+		states[string(stateKey(s.spider, r.URL))] = true
+		s.put(batch, r.URL, "", resultState(r))
+		if err = flush(); err != nil {
+			iter.Release()
+			return err
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	iter = s.db.NewIterator(util.BytesPrefix(frontierPrefix(s.spider)), nil)
+	for iter.Next() {
+		r, err := decodeRequest(iter.Value())
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		r.URL = secrets.ExpandURL(r.URL)
+		if states[string(stateKey(s.spider, r.URL))] {
+			batch.Delete(append([]byte{}, iter.Key()...))
+			batch.Delete(requestKey(s.spider, r.URL))
+		} else {
+			states[string(stateKey(s.spider, r.URL))] = true
+			s.put(batch, r.URL, "", stateQueued)
+		}
+		if err = flush(); err != nil {
+			iter.Release()
+			return err
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	if len(states) > 0 {
+		log.Infof("Worked out the crawl state of %d URLs", len(states))
+	}
+	batch.Delete(countKey(s.spider))
+	err := s.putCounts(batch)
+	if err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+// getCrawlCounts returns how many URLs of a spider are in each crawl state.
+func getCrawlCounts(db *leveldb.DB, spider string) (CrawlCounts, error) {
+	s, err := openCrawlState(db, spider)
+	if err != nil {
+		return CrawlCounts{}, err
+	}
+	return s.counts, nil
+}
+
+// resultState returns the crawl state of the URL of a result.
+func resultState(r *SpiderResult) string {
+	if r.Error != "" {
+		return stateFailed
+	}
+	return stateDone
+}
+
+// fetchable reports whether the spider can fetch a URL.
+func fetchable(u *url.URL) bool {
+	return u.Scheme == "http" || u.Scheme == "https"
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestStoreResultCounts(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	u, _ := url.Parse("http://foo.com/a")
+	assert.NoError(t, storeResult(testDB, &SpiderResult{URL: u, Response: "a"}))
+	// Storing a page again doesn't count it twice
+	assert.NoError(t, storeResult(testDB, &SpiderResult{URL: u, Response: "b"}))
+	u, _ = url.Parse("http://foo.com/b")
+	assert.NoError(t, storeResult(testDB, &SpiderResult{URL: u, Error: "Not Found"}))
+
+	counts, err := getCrawlCounts(testDB, "")
+	assert.NoError(t, err)
+	assert.Equal(t, CrawlCounts{Done: 1, Failed: 1}, counts)
+	count, err := getStoredResultCount(testDB, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Other spiders have their own counts
+	count, err = getStoredResultCount(testDB, "blog")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	testDB.Close()
+	_, err = getStoredResultCount(testDB, "")
+	assert.Error(t, err)
+}
+
+func TestCrawlStateMigrates(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	// A store as it was written before crawl states, with a count which was
+	// incremented when a page was stored again
+	for _, r := range []*SpiderResult{
+		{URL: testRequest("/a", 0, 0).URL},
+		{URL: testRequest("/b", 0, 0).URL, Error: "Not Found"},
+		{URL: testRequest("/c", 0, 0).URL, Spider: "blog"},
+	} {
+		var buffer = bytes.NewBuffer([]byte{})
+		err = gob.NewEncoder(buffer).Encode(r)
+		if err != nil {
+			panic(err)
+		}
+		err = testDB.Put(resultKey(r.Spider, r.URL), buffer.Bytes(), nil)
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = testDB.Put(countKey(""), []byte("5"), nil)
+	if err != nil {
+		panic(err)
+	}
+	f := &frontier{db: testDB, order: orderBFS}
+	batch := new(leveldb.Batch)
+	for _, r := range []*SpiderRequest{testRequest("/a", 1, 0), testRequest("/d", 1, 0)} {
+		err = f.put(batch, r)
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = testDB.Write(batch, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	f, err = openFrontier(testDB, "", orderBFS)
+	assert.NoError(t, err)
+	assert.Equal(t, CrawlCounts{Queued: 1, Done: 1, Failed: 1}, f.Counts())
+	assert.Equal(t, []string{"/d"}, frontierPaths(t, f))
+
+	has, err := testDB.Has(countKey(""), nil)
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	counts, err := getCrawlCounts(testDB, "blog")
+	assert.NoError(t, err)
+	assert.Equal(t, CrawlCounts{Done: 1}, counts)
+}
+
+func TestRunSpiderCounts(t *testing.T) {
+	testDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		panic(err)
+	}
+	defer testDB.Close()
+
+	var mu sync.Mutex
+	var requested = 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested++
+		mu.Unlock()
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		if n == 1 {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(fmt.Sprintf(`
+			<a href="/?n=%d">a</a>
+			<a href="/?n=%d">b</a>
+			<a href="mailto:foo@foo.com">mail</a>
+		`, 2*n+1, 2*n+2)))
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	rugFile := &RugFile{
+		Name: "Test",
+		Options: &ConfigOptions{
+			SpiderOptions: &ConfigSpiderOptions{
+				Concurrency: 3,
+				MaxResults:  4,
+			},
+			StoreOptions: &ConfigStoreOptions{
+				Strategy: "memory",
+			},
+		},
+		Spider: &ConfigSpider{
+			URLs:  []string{ts.URL + "/?n=0"},
+			Links: []*ConfigLinkRule{{XPath: "//a/@href"}},
+		},
+	}
+
+	// The spider makes no more requests than max, even with requests in
+	// flight when it is reached
+	err = RunSpider(testDB, rugFile, CrawlOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, requested)
+
+	counts, err := getCrawlCounts(testDB, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, counts.Done)
+	assert.Equal(t, 1, counts.Failed)
+	assert.Equal(t, 0, counts.InFlight)
+	assert.Equal(t, 1, counts.Skipped)
+	assert.True(t, counts.Queued > 0)
+
+	// A run which has already reached max makes no requests
+	err = RunSpider(testDB, rugFile, CrawlOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, requested)
+}
@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"encoding/gob"
 	"errors"
+	"net/http"
 	"net/url"
-	"strconv"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
@@ -23,14 +23,34 @@ const strategyDisk = "disk"
 const strategyMem = "memory"
 
 type SpiderRequest struct {
-	URL *url.URL
+	URL    *url.URL
+	Spider string
+	// Rule is the name of the link rule which found the URL, or empty for
+	// the start URLs
+	Rule string
+	// Depth is how many links away from a start URL the URL is
+	Depth    int
+	Priority int
+
+	// key is the frontier key of the request
+	key []byte
 }
 
 type SpiderResult struct {
-	URL      *url.URL
-	Error    string
-	Response string
-	Children []*url.URL
+	URL *url.URL
+	// Spider is the name of the spider which fetched the page, or empty for
+	// the spider of a project with only one
+	Spider     string
+	Error      string
+	StatusCode int
+	Header     http.Header
+	Response   string
+	Children   []*url.URL
+
+	// request is the request the result is for, and requests are the
+	// requests for the children. Neither is stored with the result.
+	request  *SpiderRequest
+	requests []*SpiderRequest
 }
 
 func getDB(config *ConfigStoreOptions) (*leveldb.DB, error) {
@@ -45,38 +65,49 @@ func getDB(config *ConfigStoreOptions) (*leveldb.DB, error) {
 	}
 }
 
-func getStoredResultCount(db *leveldb.DB) (int, error) {
-	var resCountInt = 0
-
-	resCount, err := db.Get([]byte("count-res"), nil)
-	if err != nil && err != lerrors.ErrNotFound {
-		return 0, nil
+// spiderKey scopes a key to a spider, so that each named spider has its own
+// requests, results and count. The spider of a project with only one isn't
+// named, and keeps the keys it had before spiders were named.
+func spiderKey(spider string, key string) string {
+	if spider == "" {
+		return key
 	}
+	return spider + "|" + key
+}
 
-	if resCount != nil {
-		resCountInt, err = strconv.Atoi(string(resCount))
-		if err != nil {
-			return 0, err
-		}
+// countKey is the key the number of stored pages of a spider was kept under
+// before crawl states existed.
+func countKey(spider string) []byte {
+	if spider == "" {
+		return []byte("count-res")
 	}
+	return []byte("count-res|" + spider)
+}
 
-	return resCountInt, nil
+// getStoredResultCount returns how many pages a spider has fetched, including
+// those which failed.
+func getStoredResultCount(db *leveldb.DB, spider string) (int, error) {
+	counts, err := getCrawlCounts(db, spider)
+	if err != nil {
+		return 0, err
+	}
+	return counts.Fetched(), nil
 }
 
-func getStoredResult(db *leveldb.DB, url string) (*SpiderResult, error) {
-	v, err := db.Get([]byte("res-"+url), nil)
+func getStoredResult(db *leveldb.DB, spider string, url string) (*SpiderResult, error) {
+	v, err := db.Get([]byte("res-"+spiderKey(spider, secrets.Redact(url))), nil)
 	if err != nil {
 		return nil, err
 	}
+	return decodeResult(v)
+}
 
-	var buffer = bytes.NewBuffer(v)
+func decodeResult(v []byte) (*SpiderResult, error) {
 	var r = &SpiderResult{}
-	d := gob.NewDecoder(buffer)
-	err = d.Decode(r)
+	err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(r)
 	if err != nil {
 		return nil, err
 	}
-
 	return r, nil
 }
 
@@ -84,52 +115,137 @@ func getResultIterator(db *leveldb.DB) iterator.Iterator {
 	return db.NewIterator(util.BytesPrefix([]byte("res-")), nil)
 }
 
+// resultKey and requestKey are the keys of a URL in the store. Secrets from
+// the config are redacted from keys and values, so they aren't written to
+// disk.
+func resultKey(spider string, u *url.URL) []byte {
+	return []byte("res-" + spiderKey(spider, secrets.Redact(u.String())))
+}
+
+func requestKey(spider string, u *url.URL) []byte {
+	return []byte("req-" + spiderKey(spider, secrets.Redact(u.String())))
+}
+
+// storeResult stores the result of a request, and sets the state of its URL
+// to done or failed.
 func storeResult(db *leveldb.DB, r *SpiderResult) error {
-	var key = "res-" + r.URL.String()
-	var buffer = bytes.NewBuffer([]byte{})
-	e := gob.NewEncoder(buffer)
-	err := e.Encode(r)
+	state, err := openCrawlState(db, r.Spider)
 	if err != nil {
 		return err
 	}
-
-	resCountInt, err := getStoredResultCount(db)
+	from, err := state.get(r.URL)
 	if err != nil {
 		return err
 	}
 
-	transaction, err := db.OpenTransaction()
+	batch := new(leveldb.Batch)
+	err = putResult(batch, r)
 	if err != nil {
 		return err
 	}
-
-	err = transaction.Put([]byte(key), buffer.Bytes(), nil)
+	err = state.set(batch, r.URL, from, resultState(r))
 	if err != nil {
 		return err
 	}
+	return db.Write(batch, nil)
+}
 
-	resCountInt++
-
-	resCountString := strconv.Itoa(resCountInt)
-	err = transaction.Put([]byte("count-res"), []byte(resCountString), nil)
+func putResult(batch *leveldb.Batch, r *SpiderResult) error {
+	var buffer = bytes.NewBuffer([]byte{})
+	err := gob.NewEncoder(buffer).Encode(secrets.RedactResult(r))
 	if err != nil {
 		return err
 	}
+	batch.Put(resultKey(r.Spider, r.URL), buffer.Bytes())
+	return nil
+}
 
-	return transaction.Commit()
+func hasResult(db *leveldb.DB, spider string, url *url.URL) (bool, error) {
+	return db.Has(resultKey(spider, url), nil)
 }
 
-func storeRequest(db *leveldb.DB, r *SpiderRequest) error {
-	var key = "req-" + r.URL.String()
-	var buffer = bytes.NewBuffer([]byte{})
-	e := gob.NewEncoder(buffer)
-	err := e.Encode(r)
+func scrapedKey(scraper string, url string) []byte {
+	return []byte("scr-" + scraper + "|" + url)
+}
+
+func getScrapedHash(db *leveldb.DB, scraper string, url string) (string, error) {
+	v, err := db.Get(scrapedKey(scraper, url), nil)
+	if err == lerrors.ErrNotFound {
+		return "", nil
+	}
 	if err != nil {
+		return "", err
+	}
+	return string(v), nil
+}
+
+func putScrapedHash(batch *leveldb.Batch, scraper string, url string, hash string) {
+	batch.Put(scrapedKey(scraper, url), []byte(hash))
+}
+
+func clearScraped(db *leveldb.DB, scraper string) error {
+	iter := db.NewIterator(util.BytesPrefix([]byte("scr-"+scraper+"|")), nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	if err := iter.Error(); err != nil {
 		return err
 	}
-	return db.Put([]byte(key), buffer.Bytes(), nil)
+
+	return db.Write(batch, nil)
 }
 
-func hasResult(db *leveldb.DB, url *url.URL) (bool, error) {
-	return db.Has([]byte("res-"+url.String()), nil)
+func dedupeKey(scraper string, key string) []byte {
+	return []byte("dup-" + scraper + "|" + key)
+}
+
+func dedupePendingKey(scraper string, key string) []byte {
+	return []byte("dpn-" + scraper + "|" + key)
+}
+
+func getDedupeRecord(db *leveldb.DB, scraper string, key string) ([]byte, error) {
+	v, err := db.Get(dedupeKey(scraper, key), nil)
+	if err == lerrors.ErrNotFound {
+		return nil, nil
+	}
+	return v, err
+}
+
+func hasDedupePending(db *leveldb.DB, scraper string, key string) (bool, error) {
+	return db.Has(dedupePendingKey(scraper, key), nil)
+}
+
+// storePendingDedupeRecord stores the record for a key, and marks the key to
+// be written out once the scraper has finished.
+func storePendingDedupeRecord(db *leveldb.DB, scraper string, key string, record []byte) error {
+	batch := new(leveldb.Batch)
+	putDedupeRecord(batch, scraper, key, record)
+	batch.Put(dedupePendingKey(scraper, key), []byte{})
+	return db.Write(batch, nil)
+}
+
+func putDedupeRecord(batch *leveldb.Batch, scraper string, key string, record []byte) {
+	batch.Put(dedupeKey(scraper, key), record)
+}
+
+func getDedupePendingIterator(db *leveldb.DB, scraper string) iterator.Iterator {
+	return db.NewIterator(util.BytesPrefix([]byte("dpn-"+scraper+"|")), nil)
+}
+
+func clearDedupe(db *leveldb.DB, scraper string) error {
+	batch := new(leveldb.Batch)
+	for _, prefix := range []string{"dup-", "dpn-"} {
+		iter := db.NewIterator(util.BytesPrefix([]byte(prefix+scraper+"|")), nil)
+		for iter.Next() {
+			batch.Delete(iter.Key())
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+	return db.Write(batch, nil)
 }
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/lestrrat/go-libxml2/types"
+	"github.com/lestrrat/go-libxml2/xpath"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	luajson "layeh.com/gopher-json"
+)
+
+// Transform transforms the records produced by a scraper.
+type Transform interface {
+	Name() string
+	// Apply transforms a record into zero or more records. page is the page
+	// the record was scraped from, or nil if it wasn't.
+	Apply(record map[string]interface{}, page *PageContext) ([]map[string]interface{}, error)
+	// Finish is called once the scraper has been run, and returns any
+	// records the transform has left to write.
+	Finish() ([]map[string]interface{}, error)
+	// Finishes reports whether Finish may return records, which aggregate
+	// every record the transform has seen.
+	Finishes() bool
+	Close()
+}
+
+// ScriptTransform is a transform written in Lua or JavaScript. Scripts can
+// also be used as field transforms, which transform the value of a single
+// field. Their states are pooled, and a state goes back to the pool even if
+// a call fails, so that whatever the transform has accumulated in it is kept.
+type ScriptTransform interface {
+	Transform
+	// ApplyValue transforms the value of a single field.
+	ApplyValue(value interface{}) (interface{}, error)
+}
+
+// LuaTransform is a Lua transform compiled once and run on a pool of warmed
+// Lua states. States are reused between records, so globals set by the
+// transform persist for the whole scraper run.
+//
+// Besides transform, a transform may define init, which is called when a
+// state is created, and finish, which is called once the scraper has been
+// run and may return records of its own.
+type LuaTransform struct {
+	name     string
+	proto    *lua.FunctionProto
+	limits   TransformLimits
+	finishes bool
+	m        sync.Mutex
+	pool     []*luaState
+}
+
+type luaState struct {
+	l   *lua.LState
+	ctx *transformCallContext
+}
+
+// NewLuaTransform compiles the Lua source of a transform and loads it into a
+// first Lua state, so that syntax errors and errors in the top level of the
+// transform are reported straight away. Transforms run in a sandbox, and each
+// call is stopped if it exceeds limits.
+func NewLuaTransform(name string, source string, limits TransformLimits) (*LuaTransform, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		if perr, ok := err.(*parse.Error); ok {
+			return nil, fmt.Errorf("Syntax error in transform %s:%d:%d: %s", name, perr.Pos.Line, perr.Pos.Column, perr.Message)
+		}
+		return nil, fmt.Errorf("Syntax error in transform %s: %s", name, err)
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to compile transform %s: %s", name, err)
+	}
+
+	t := &LuaTransform{
+		name:   name,
+		proto:  proto,
+		limits: limits,
+	}
+
+	st, err := t.newState()
+	if err != nil {
+		return nil, err
+	}
+	_, t.finishes = st.l.GetGlobal("finish").(*lua.LFunction)
+	t.put(st)
+
+	return t, nil
+}
+
+func (t *LuaTransform) Name() string {
+	return t.name
+}
+
+// Finishes reports whether the transform defines a finish function.
+func (t *LuaTransform) Finishes() bool {
+	return t.finishes
+}
+
+func (t *LuaTransform) newState() (*luaState, error) {
+	ctx := &transformCallContext{transform: t.name}
+	l := newSandboxState()
+	luajson.Preload(l)
+	// json is also a global, as it was before transforms were compiled once,
+	// so that transforms which use it without require still work
+	l.Push(l.NewFunction(luajson.Loader))
+	l.Call(0, 1)
+	l.SetGlobal("json", l.Get(-1))
+	l.Pop(1)
+	preloadRugburn(l, ctx)
+	err := callWithLimits(t.name, t.limits, luaInterrupt(l), func() error {
+		l.Push(l.NewFunctionFromProto(t.proto))
+		return l.PCall(0, lua.MultRet, nil)
+	})
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("Failed to load transform %s: %s", t.name, luaErrorMessage(err))
+	}
+	if _, ok := l.GetGlobal("transform").(*lua.LFunction); !ok {
+		l.Close()
+		return nil, fmt.Errorf("Transform %s doesn't define a transform function", t.name)
+	}
+	if init, ok := l.GetGlobal("init").(*lua.LFunction); ok {
+		err = callWithLimits(t.name, t.limits, luaInterrupt(l), func() error {
+			return l.CallByParam(lua.P{
+				Fn:      init,
+				NRet:    0,
+				Protect: true,
+			})
+		})
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("Failed to initialize transform %s: %s", t.name, luaErrorMessage(err))
+		}
+	}
+	return &luaState{l: l, ctx: ctx}, nil
+}
+
+func (t *LuaTransform) get() (*luaState, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	n := len(t.pool)
+	if n == 0 {
+		return t.newState()
+	}
+	st := t.pool[n-1]
+	t.pool = t.pool[:n-1]
+	return st, nil
+}
+
+func (t *LuaTransform) put(st *luaState) {
+	st.ctx.record = nil
+	st.ctx.page = nil
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.pool = append(t.pool, st)
+}
+
+// Close closes the pooled Lua states.
+func (t *LuaTransform) Close() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, st := range t.pool {
+		st.l.Close()
+	}
+	t.pool = nil
+}
+
+// ExprTransform is a declarative transform made of expressions. Records which
+// don't match where are dropped, then the fields in set are set, then fields
+// are renamed, and finally the fields in drop are removed.
+type ExprTransform struct {
+	name   string
+	where  exprFunc
+	set    map[string]exprFunc
+	rename map[string]string
+	drop   []string
+}
+
+// NewExprTransform compiles the expressions of a transform.
+func NewExprTransform(name string, config *ConfigTransform) (*ExprTransform, error) {
+	t := &ExprTransform{
+		name:   name,
+		set:    map[string]exprFunc{},
+		rename: config.Rename,
+		drop:   config.Drop,
+	}
+
+	if config.Where != "" {
+		where, err := compileExpr(config.Where)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid where in transform %s: %s", name, err)
+		}
+		t.where = where
+	}
+
+	for k, v := range config.Set {
+		fn, err := compileExpr(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid set \"%s\" in transform %s: %s", k, name, err)
+		}
+		t.set[k] = fn
+	}
+
+	return t, nil
+}
+
+func (t *ExprTransform) Name() string {
+	return t.name
+}
+
+func (t *ExprTransform) Apply(record map[string]interface{}, page *PageContext) ([]map[string]interface{}, error) {
+	if t.where != nil {
+		v, err := t.where(record)
+		if err != nil {
+			return nil, err
+		}
+		if !exprTruthy(v) {
+			return []map[string]interface{}{}, nil
+		}
+	}
+
+	// Every expression sees the record as it was before any fields were set
+	var values = make(map[string]interface{})
+	for k, fn := range t.set {
+		v, err := fn(record)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set \"%s\": %s", k, err)
+		}
+		values[k] = v
+	}
+
+	var result = make(map[string]interface{})
+	for k, v := range record {
+		result[k] = v
+	}
+	for k, v := range values {
+		result[k] = v
+	}
+	// Every field is renamed from the record as it was before any were
+	// renamed, so that renames which swap or chain fields don't depend on
+	// the order they are applied in
+	var renamed = make(map[string]interface{})
+	for from, to := range t.rename {
+		if v, ok := result[from]; ok {
+			renamed[to] = v
+		}
+	}
+	for from := range t.rename {
+		delete(result, from)
+	}
+	for k, v := range renamed {
+		result[k] = v
+	}
+	for _, k := range t.drop {
+		delete(result, k)
+	}
+
+	return []map[string]interface{}{result}, nil
+}
+
+func (t *ExprTransform) Finish() ([]map[string]interface{}, error) {
+	return nil, nil
+}
+
+func (t *ExprTransform) Finishes() bool {
+	return false
+}
+
+func (t *ExprTransform) Close() {}
+
+// UnmarshalJSON accepts either the path of a Lua or JavaScript transform, or
+// an object.
+func (c *ConfigTransform) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		c.Path = path
+		return nil
+	}
+
+	type configTransform ConfigTransform
+	return json.Unmarshal(data, (*configTransform)(c))
+}
+
+// isExpr reports whether the transform is an expression transform rather
+// than a script.
+func (c *ConfigTransform) isExpr() bool {
+	return c.Where != "" || len(c.Set) > 0 || len(c.Rename) > 0 || len(c.Drop) > 0
+}
+
+// PageContext is the page a record was scraped from.
+type PageContext struct {
+	Scraper string
+	Result  *SpiderResult
+	// Node is the context node of the record, or the document if the scraper
+	// has no context.
+	Node types.Node
+}
+
+// Apply runs the transform function over a record. The function may return a
+// table to replace the record, nil to drop it, or an array of tables to
+// replace it with several records. page may be nil if the record didn't come
+// from a page.
+func (t *LuaTransform) Apply(result map[string]interface{}, page *PageContext) ([]map[string]interface{}, error) {
+	st, err := t.get()
+	if err != nil {
+		return nil, err
+	}
+	l := st.l
+	st.ctx.record = result
+	st.ctx.page = page
+
+	record, err := toLValue(l, result)
+	if err != nil {
+		t.put(st)
+		return nil, err
+	}
+
+	ctx, release := newLuaPageContext(l, page)
+	err = callWithLimits(t.name, t.limits, luaInterrupt(l), func() error {
+		return l.CallByParam(lua.P{
+			Fn:      l.GetGlobal("transform"),
+			NRet:    1,
+			Protect: true,
+		}, record, ctx)
+	})
+	release()
+	if err != nil {
+		l.SetTop(0)
+		t.put(st)
+		return nil, errors.New(luaErrorMessage(err))
+	}
+	ret := l.Get(-1)
+	l.Pop(1)
+	t.put(st)
+
+	value, err := fromLValue(ret, map[*lua.LTable]bool{})
+	if err != nil {
+		return nil, err
+	}
+
+	return transformResults(value)
+}
+
+// ApplyValue runs the transform function over the value of a single field,
+// and returns the value it returns.
+func (t *LuaTransform) ApplyValue(value interface{}) (interface{}, error) {
+	st, err := t.get()
+	if err != nil {
+		return nil, err
+	}
+	l := st.l
+
+	lv, err := toLValue(l, value)
+	if err != nil {
+		t.put(st)
+		return nil, err
+	}
+
+	err = callWithLimits(t.name, t.limits, luaInterrupt(l), func() error {
+		return l.CallByParam(lua.P{
+			Fn:      l.GetGlobal("transform"),
+			NRet:    1,
+			Protect: true,
+		}, lv)
+	})
+	if err != nil {
+		l.SetTop(0)
+		t.put(st)
+		return nil, errors.New(luaErrorMessage(err))
+	}
+	ret := l.Get(-1)
+	l.Pop(1)
+	t.put(st)
+
+	return fromLValue(ret, map[*lua.LTable]bool{})
+}
+
+// Finish calls the finish function of the transform, if it has one, and
+// returns the records it returned.
+func (t *LuaTransform) Finish() ([]map[string]interface{}, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	var results = []map[string]interface{}{}
+	for _, st := range t.pool {
+		l := st.l
+		finish, ok := l.GetGlobal("finish").(*lua.LFunction)
+		if !ok {
+			continue
+		}
+
+		err := callWithLimits(t.name, t.limits, luaInterrupt(l), func() error {
+			return l.CallByParam(lua.P{
+				Fn:      finish,
+				NRet:    1,
+				Protect: true,
+			})
+		})
+		if err != nil {
+			l.SetTop(0)
+			return nil, fmt.Errorf("Transform %s failed in finish: %s", t.name, luaErrorMessage(err))
+		}
+		ret := l.Get(-1)
+		l.Pop(1)
+
+		value, err := fromLValue(ret, map[*lua.LTable]bool{})
+		if err != nil {
+			return nil, err
+		}
+		finished, err := transformResults(value)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, finished...)
+	}
+
+	return results, nil
+}
+
+// luaErrorMessage returns the message of a Lua error, which includes the file
+// name and line number, without the Lua stack trace.
+func luaErrorMessage(err error) string {
+	if aerr, ok := err.(*lua.ApiError); ok && aerr.Object != nil {
+		return aerr.Object.String()
+	}
+	return err.Error()
+}
+
+// newLuaPageContext creates the ctx argument of a transform function. The
+// page is freed once it has been scraped, so release must be called when the
+// function returns, after which ctx.xpath and ctx.xpathAll raise an error
+// rather than reading the freed page.
+func newLuaPageContext(l *lua.LState, page *PageContext) (*lua.LTable, func()) {
+	ctx := l.NewTable()
+	if page == nil {
+		return ctx, func() {}
+	}
+
+	ctx.RawSetString("scraper", lua.LString(page.Scraper))
+	if page.Result != nil {
+		ctx.RawSetString("url", lua.LString(page.Result.URL.String()))
+		ctx.RawSetString("status", lua.LNumber(page.Result.StatusCode))
+		headers := l.NewTable()
+		for k, v := range page.Result.Header {
+			headers.RawSetString(k, lua.LString(strings.Join(v, ", ")))
+		}
+		ctx.RawSetString("headers", headers)
+	}
+
+	var released = false
+	if page.Node != nil {
+		find := func(l *lua.LState) []string {
+			if released {
+				l.RaiseError("ctx.xpath can only be used while the transform is called for the page")
+			}
+			values, err := findText(page.Node, l.CheckString(1))
+			if err != nil {
+				l.ArgError(1, err.Error())
+			}
+			return values
+		}
+		ctx.RawSetString("xpath", l.NewFunction(func(l *lua.LState) int {
+			values := find(l)
+			if len(values) == 0 {
+				l.Push(lua.LNil)
+				return 1
+			}
+			l.Push(lua.LString(values[0]))
+			return 1
+		}))
+		ctx.RawSetString("xpathAll", l.NewFunction(func(l *lua.LState) int {
+			l.Push(luaStringArray(l, find(l)))
+			return 1
+		}))
+	}
+
+	return ctx, func() { released = true }
+}
+
+// findText returns the text of the nodes matching an XPath relative to node.
+func findText(node types.Node, expr string) ([]string, error) {
+	xpCtx, err := xpath.NewContext(node)
+	if err != nil {
+		return nil, err
+	}
+	defer xpCtx.Free()
+	xpResult, err := xpCtx.Find(expr)
+	if err != nil {
+		return nil, err
+	}
+	defer xpResult.Free()
+	var values = []string{}
+	for _, n := range xpResult.NodeList() {
+		values = append(values, n.TextContent())
+	}
+	return values, nil
+}
+
+func transformResults(v interface{}) ([]map[string]interface{}, error) {
+	switch value := v.(type) {
+	case nil:
+		return []map[string]interface{}{}, nil
+	case map[string]interface{}:
+		return []map[string]interface{}{value}, nil
+	case []interface{}:
+		var results = []map[string]interface{}{}
+		for _, r := range value {
+			result, ok := r.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Unexpected value in array returned by transform. Should be a table.")
+			}
+			results = append(results, result)
+		}
+		return results, nil
+	default:
+		return nil, fmt.Errorf("Unexpected value returned by transform. Should be a table, an array of tables or nil.")
+	}
+}
+
+// toLValue converts a record value into a Lua value.
+func toLValue(l *lua.LState, v interface{}) (lua.LValue, error) {
+	switch value := v.(type) {
+	case nil:
+		return lua.LNil, nil
+	case string:
+		return lua.LString(value), nil
+	case bool:
+		return lua.LBool(value), nil
+	case float64:
+		return lua.LNumber(value), nil
+	case int:
+		return lua.LNumber(value), nil
+	case []string:
+		t := l.CreateTable(len(value), 0)
+		for _, s := range value {
+			t.Append(lua.LString(s))
+		}
+		return t, nil
+	case []map[string]interface{}:
+		t := l.CreateTable(len(value), 0)
+		for _, m := range value {
+			lv, err := toLValue(l, m)
+			if err != nil {
+				return nil, err
+			}
+			t.Append(lv)
+		}
+		return t, nil
+	case []interface{}:
+		t := l.CreateTable(len(value), 0)
+		for _, i := range value {
+			lv, err := toLValue(l, i)
+			if err != nil {
+				return nil, err
+			}
+			t.Append(lv)
+		}
+		return t, nil
+	case map[string]interface{}:
+		t := l.CreateTable(0, len(value))
+		for k, i := range value {
+			lv, err := toLValue(l, i)
+			if err != nil {
+				return nil, err
+			}
+			t.RawSetString(k, lv)
+		}
+		return t, nil
+	default:
+		// Anything else is converted through its JSON representation
+		j, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		var i interface{}
+		err = json.Unmarshal(j, &i)
+		if err != nil {
+			return nil, err
+		}
+		return toLValue(l, i)
+	}
+}
+
+// fromLValue converts a Lua value into a record value. Tables with array
+// elements, and empty tables, are converted into arrays.
+func fromLValue(v lua.LValue, visited map[*lua.LTable]bool) (interface{}, error) {
+	switch value := v.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(value), nil
+	case lua.LString:
+		return string(value), nil
+	case lua.LNumber:
+		return float64(value), nil
+	case *lua.LTable:
+		if visited[value] {
+			return nil, errors.New("Transform returned a table which contains itself")
+		}
+		visited[value] = true
+		defer delete(visited, value)
+
+		if value.MaxN() > 0 || isEmptyTable(value) {
+			if !isArrayTable(value) {
+				return nil, errors.New("Transform returned a table with both array items and keys")
+			}
+			var array = []interface{}{}
+			for i := 1; i <= value.MaxN(); i++ {
+				item, err := fromLValue(value.RawGetInt(i), visited)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, item)
+			}
+			return array, nil
+		}
+
+		var m = make(map[string]interface{})
+		var err error
+		value.ForEach(func(k lua.LValue, lv lua.LValue) {
+			if err != nil {
+				return
+			}
+			var item interface{}
+			item, err = fromLValue(lv, visited)
+			m[k.String()] = item
+		})
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("Unexpected %s value returned by transform", v.Type())
+	}
+}
+
+// isArrayTable reports whether every key of a table is an index of its
+// array items, so that it can be converted to an array without losing any.
+func isArrayTable(t *lua.LTable) bool {
+	var array = true
+	t.ForEach(func(k lua.LValue, v lua.LValue) {
+		n, ok := k.(lua.LNumber)
+		if !ok || float64(n) != float64(int(n)) || int(n) < 1 || int(n) > t.MaxN() {
+			array = false
+		}
+	})
+	return array
+}
+
+func isEmptyTable(t *lua.LTable) bool {
+	k, _ := t.Next(lua.LNil)
+	return k == lua.LNil
+}
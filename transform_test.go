@@ -0,0 +1,366 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	libxml2 "github.com/lestrrat/go-libxml2"
+	"github.com/lestrrat/go-libxml2/xpath"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLuaJSON(t *testing.T) {
+	var value = make(map[string]interface{})
+	value["foo"] = 10
+	transform, err := NewLuaTransform("test.lua", `
+		function transform(state)
+			state["foo"] = 20
+			return state
+		end
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	result, err := transform.Apply(value, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, result[0]["foo"], float64(20))
+}
+
+func TestLuaDrop(t *testing.T) {
+	var value = make(map[string]interface{})
+	value["foo"] = 10
+	transform, err := NewLuaTransform("test.lua", `
+		function transform(state)
+			if state["foo"] < 20 then
+				return nil
+			end
+			return state
+		end
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	result, err := transform.Apply(value, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(result))
+}
+
+func TestLuaFanOut(t *testing.T) {
+	var value = make(map[string]interface{})
+	value["fields"] = []map[string]interface{}{
+		{"title": "title1"},
+		{"title": "title2"},
+	}
+	transform, err := NewLuaTransform("test.lua", `
+		function transform(state)
+			return state["fields"]
+		end
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	result, err := transform.Apply(value, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, "title1", result[0]["title"])
+	assert.Equal(t, "title2", result[1]["title"])
+}
+
+func TestLuaStateReused(t *testing.T) {
+	transform, err := NewLuaTransform("test.lua", `
+		local json = require("json")
+		count = 0
+
+		function transform(state)
+			count = count + 1
+			state["count"] = count
+			state["encoded"] = json.encode({ok = true})
+			return state
+		end
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+	assert.False(t, transform.Finishes())
+
+	for i := 1; i <= 3; i++ {
+		result, err := transform.Apply(map[string]interface{}{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, float64(i), result[0]["count"])
+		assert.Equal(t, `{"ok":true}`, result[0]["encoded"])
+	}
+}
+
+func TestLuaJSONGlobal(t *testing.T) {
+	transform, err := NewLuaTransform("test.lua", `
+		function transform(state)
+			state["encoded"] = json.encode({ok = true})
+			state["decoded"] = json.decode('{"n": 1}')["n"]
+			return state
+		end
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	// json can be used without require
+	result, err := transform.Apply(map[string]interface{}{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"ok":true}`, result[0]["encoded"])
+	assert.Equal(t, float64(1), result[0]["decoded"])
+}
+
+func TestLuaNativeTables(t *testing.T) {
+	transform, err := NewLuaTransform("test.lua", `
+		function transform(state)
+			state["n"] = #state["tags"]
+			state["first"] = state["nested"][1]["title"]
+			return state
+		end
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	result, err := transform.Apply(map[string]interface{}{
+		"tags":   []string{"a", "b"},
+		"nested": []map[string]interface{}{{"title": "title1"}},
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), result[0]["n"])
+	assert.Equal(t, "title1", result[0]["first"])
+	assert.Equal(t, []interface{}{"a", "b"}, result[0]["tags"])
+}
+
+func TestLuaMixedTable(t *testing.T) {
+	transform, err := NewLuaTransform("test.lua", `
+		function transform(state)
+			state["tags"] = {"a", "b", name = "c"}
+			return state
+		end
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	// A table with both array items and keys can't be converted without
+	// losing some of them
+	_, err = transform.Apply(map[string]interface{}{}, nil)
+	assert.EqualError(t, err, "Transform returned a table with both array items and keys")
+}
+
+func TestLuaSyntaxError(t *testing.T) {
+	_, err := NewLuaTransform("broken.lua", "function transform(state)\n\treturn state\n", TransformLimits{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "broken.lua")
+
+	_, err = NewLuaTransform("missing.lua", "function other(state)\n\treturn state\nend\n", TransformLimits{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "missing.lua")
+}
+
+func TestLuaRuntimeError(t *testing.T) {
+	transform, err := NewLuaTransform("runtime.lua", "function transform(state)\n\treturn state.missing.field\nend\n", TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	_, err = transform.Apply(map[string]interface{}{}, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "runtime.lua:2:")
+}
+
+func TestLuaSandbox(t *testing.T) {
+	for _, source := range []string{
+		`function transform(state) state["v"] = os.getenv("HOME") return state end`,
+		`function transform(state) state["v"] = io.open("rug.json") return state end`,
+		`function transform(state) dofile("rug.json") return state end`,
+		`function transform(state) require("os").execute("true") return state end`,
+		`function transform(state) require("transforms.other") return state end`,
+	} {
+		transform, err := NewLuaTransform("test.lua", source, TransformLimits{})
+		assert.NoError(t, err)
+
+		_, err = transform.Apply(map[string]interface{}{}, nil)
+		assert.Error(t, err, source)
+		transform.Close()
+	}
+}
+
+func TestLuaTimeLimit(t *testing.T) {
+	transform, err := NewLuaTransform("test.lua", `
+		function transform(state)
+			while true do end
+		end
+	`, TransformLimits{Timeout: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	_, err = transform.Apply(map[string]interface{}{}, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "time limit")
+}
+
+func TestTransformMemoryLimit(t *testing.T) {
+	var limits = TransformLimits{MaxMemory: 16 * 1024 * 1024}
+	transform, err := NewLuaTransform("test.lua", `
+		kept = {}
+		function transform(state)
+			table.insert(kept, string.rep("x", 1024 * 1024) .. #kept)
+			return state
+		end
+	`, limits)
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	// Memory which transforms keep between calls is caught once it grows
+	// past the limit
+	memory := newMemoryLimit(limits)
+	assert.NoError(t, memory.check())
+	for i := 0; i < 64 && err == nil; i++ {
+		_, err = transform.Apply(map[string]interface{}{}, nil)
+		assert.NoError(t, err)
+		err = memory.check()
+	}
+	assert.EqualError(t, err, "Transforms exceeded their memory limit of 16 MB")
+
+	assert.NoError(t, newMemoryLimit(TransformLimits{}).check())
+}
+
+func TestRegexpCache(t *testing.T) {
+	cache := newRegexpCache(2)
+
+	a, err := cache.compile("a+")
+	assert.NoError(t, err)
+	again, err := cache.compile("a+")
+	assert.NoError(t, err)
+	assert.True(t, a == again)
+
+	_, err = cache.compile("b+")
+	assert.NoError(t, err)
+	_, err = cache.compile("(")
+	assert.Error(t, err)
+	assert.Len(t, cache.regexps, 2)
+
+	// Full, so it is cleared before the next is added
+	_, err = cache.compile("c+")
+	assert.NoError(t, err)
+	assert.Len(t, cache.regexps, 1)
+}
+
+func TestLuaRugburnModule(t *testing.T) {
+	transform, err := NewLuaTransform("test.lua", `
+		local rugburn = require("rugburn")
+
+		function transform(state)
+			state["trimmed"] = rugburn.strings.trim("  title  ")
+			state["parts"] = rugburn.strings.split("a,b", ",")
+			state["matched"] = rugburn.re.match("^\\d+$", "123")
+			state["number"] = rugburn.re.find("(\\d+) points", "42 points")
+			state["replaced"] = rugburn.re.replace("\\s+", "a  b", "-")
+			state["date"] = rugburn.time.format("2006-01-02", rugburn.time.parse("Jan 2, 2006", "Oct 19, 2017"))
+			state["host"] = rugburn.url.parse("https://news.ycombinator.com/item?id=1").host
+			state["resolved"] = rugburn.url.resolve("https://news.ycombinator.com/news", "item?id=1")
+			state["id"] = rugburn.url.query("item?id=1")["id"]
+			state["sha1"] = rugburn.hash.sha1("rugburn")
+			state["md5"] = rugburn.hash.md5("rugburn")
+			state["text"] = rugburn.html.stripTags("<b>Fish &amp; Chips</b>")
+			state["unescaped"] = rugburn.html.unescape("&lt;b&gt;")
+			rugburn.log.debug("transformed")
+			return state
+		end
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	result, err := transform.Apply(map[string]interface{}{}, nil)
+	assert.NoError(t, err)
+	r := result[0]
+	assert.Equal(t, "title", r["trimmed"])
+	assert.Equal(t, []interface{}{"a", "b"}, r["parts"])
+	assert.Equal(t, true, r["matched"])
+	assert.Equal(t, "42 points", r["number"])
+	assert.Equal(t, "a-b", r["replaced"])
+	assert.Equal(t, "2017-10-19", r["date"])
+	assert.Equal(t, "news.ycombinator.com", r["host"])
+	assert.Equal(t, "https://news.ycombinator.com/item?id=1", r["resolved"])
+	assert.Equal(t, "1", r["id"])
+	assert.Equal(t, "8c4c3ecfd6227e58773741f9531c45b9cacf0527", r["sha1"])
+	assert.Equal(t, "74eae47c6cdf06ff823ef40eaaed0406", r["md5"])
+	assert.Equal(t, "Fish & Chips", r["text"])
+	assert.Equal(t, "<b>", r["unescaped"])
+}
+
+func TestLuaPageContext(t *testing.T) {
+	transform, err := NewLuaTransform("test.lua", `
+		function transform(state, ctx)
+			state["url"] = ctx.url
+			state["status"] = ctx.status
+			state["type"] = ctx.headers["Content-Type"]
+			state["scraper"] = ctx.scraper
+			state["title"] = ctx.xpath("./span/text()")
+			state["links"] = ctx.xpathAll("./a/@href")
+			state["missing"] = ctx.xpath("./p")
+			return state
+		end
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	doc, err := libxml2.ParseHTMLString(`<html><body><div><span>title1</span><a href="/a">a</a><a href="/b">b</a></div></body></html>`)
+	assert.NoError(t, err)
+	defer doc.Free()
+
+	ctx, err := xpath.NewContext(doc)
+	assert.NoError(t, err)
+	defer ctx.Free()
+
+	xpResult, err := ctx.Find("//div")
+	assert.NoError(t, err)
+	defer xpResult.Free()
+	nodes := xpResult.NodeList()
+
+	u, _ := url.Parse("http://foo.com")
+	result, err := transform.Apply(map[string]interface{}{}, &PageContext{
+		Scraper: "Test",
+		Result: &SpiderResult{
+			URL:        u,
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": []string{"text/html"}},
+		},
+		Node: nodes[0],
+	})
+	assert.NoError(t, err)
+	r := result[0]
+	assert.Equal(t, "http://foo.com", r["url"])
+	assert.Equal(t, float64(200), r["status"])
+	assert.Equal(t, "text/html", r["type"])
+	assert.Equal(t, "Test", r["scraper"])
+	assert.Equal(t, "title1", r["title"])
+	assert.Equal(t, []interface{}{"/a", "/b"}, r["links"])
+	assert.Nil(t, r["missing"])
+}
+
+func TestLuaPageContextReleased(t *testing.T) {
+	transform, err := NewLuaTransform("test.lua", `
+		function transform(state, ctx)
+			if saved ~= nil then
+				state["title"] = saved.xpath("./span/text()")
+			end
+			saved = ctx
+			return state
+		end
+	`, TransformLimits{})
+	assert.NoError(t, err)
+	defer transform.Close()
+
+	doc, err := libxml2.ParseHTMLString(`<html><body><span>title1</span></body></html>`)
+	assert.NoError(t, err)
+	defer doc.Free()
+
+	_, err = transform.Apply(map[string]interface{}{}, &PageContext{Scraper: "Test", Node: doc})
+	assert.NoError(t, err)
+
+	// The ctx of a page can't read it once the transform has returned, as
+	// the page may have been freed
+	_, err = transform.Apply(map[string]interface{}{}, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ctx.xpath can only be used while the transform is called for the page")
+}
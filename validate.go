@@ -0,0 +1,552 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat/go-libxml2/xpath"
+)
+
+// ConfigProblem is a problem with a rug.json, along with the JSON path of the
+// value it was found in.
+type ConfigProblem struct {
+	Path    string
+	Message string
+}
+
+// ValidationError lists every problem found in a rug.json.
+type ValidationError struct {
+	File     string
+	Problems []ConfigProblem
+}
+
+func (e *ValidationError) Error() string {
+	var lines = []string{fmt.Sprintf("Invalid config in %s:", e.File)}
+	for _, p := range e.Problems {
+		lines = append(lines, fmt.Sprintf("  %s: %s", p.Path, p.Message))
+	}
+	return strings.Join(lines, "\n")
+}
+
+type configProblems []ConfigProblem
+
+func (p *configProblems) add(path string, format string, args ...interface{}) {
+	if path == "" {
+		path = "(root)"
+	}
+	*p = append(*p, ConfigProblem{path, fmt.Sprintf(format, args...)})
+}
+
+// validateRugFile decodes a rug.json, returning every problem found in it.
+// Unknown keys and values of the wrong type are reported first, then missing
+// blocks, XPaths which don't compile and transforms which can't be loaded.
+func validateRugFile(data []byte) (*RugFile, []ConfigProblem, error) {
+	var raw interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var problems = configProblems{}
+	checkConfigValue(&problems, "", raw, reflect.TypeOf(RugFile{}))
+	if len(problems) > 0 {
+		return nil, problems, nil
+	}
+
+	rugFile := &RugFile{}
+	err = json.Unmarshal(data, rugFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	checkRugFile(&problems, rugFile)
+	return rugFile, problems, nil
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// checkConfigValue checks that a decoded JSON value matches the config type t,
+// reporting unknown keys and values of the wrong type.
+func checkConfigValue(p *configProblems, path string, raw interface{}, t reflect.Type) {
+	if raw == nil {
+		return
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	// Types with their own UnmarshalJSON may also be given as a string
+	if _, ok := raw.(string); ok && reflect.PtrTo(t).Implements(unmarshalerType) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			p.add(path, "should be an object")
+			return
+		}
+		var fields = map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			fields[jsonName(t.Field(i))] = t.Field(i).Type
+		}
+		for _, k := range sortedKeys(object) {
+			ft, ok := fields[k]
+			if !ok {
+				if suggestion := closestKey(k, fields); suggestion != "" {
+					p.add(joinPath(path, k), "unknown key, did you mean \"%s\"?", suggestion)
+				} else {
+					p.add(joinPath(path, k), "unknown key")
+				}
+				continue
+			}
+			checkConfigValue(p, joinPath(path, k), object[k], ft)
+		}
+	case reflect.Slice:
+		array, ok := raw.([]interface{})
+		if !ok {
+			p.add(path, "should be an array")
+			return
+		}
+		for i, v := range array {
+			checkConfigValue(p, fmt.Sprintf("%s[%d]", path, i), v, t.Elem())
+		}
+	case reflect.Map:
+		object, ok := raw.(map[string]interface{})
+		if !ok {
+			p.add(path, "should be an object")
+			return
+		}
+		for _, k := range sortedKeys(object) {
+			checkConfigValue(p, joinPath(path, k), object[k], t.Elem())
+		}
+	case reflect.String:
+		if _, ok := raw.(string); !ok {
+			p.add(path, "should be a string")
+		}
+	case reflect.Int:
+		if n, ok := raw.(float64); !ok || n != float64(int(n)) {
+			p.add(path, "should be an integer")
+		}
+	case reflect.Bool:
+		if _, ok := raw.(bool); !ok {
+			p.add(path, "should be true or false")
+		}
+	}
+}
+
+func jsonName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	var keys = []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// closestKey returns the known key closest to an unknown one, if there is one
+// close enough to be a typo.
+func closestKey(key string, known map[string]reflect.Type) string {
+	var closest string
+	var best = 3
+	for k := range known {
+		d := editDistance(strings.ToLower(key), strings.ToLower(k))
+		if d < best || (d == best && k < closest) {
+			closest = k
+			best = d
+		}
+	}
+	return closest
+}
+
+func editDistance(a string, b string) int {
+	var prev = make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		var cur = make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// checkRugFile checks the values of a decoded rug.json.
+func checkRugFile(p *configProblems, rugFile *RugFile) {
+	if rugFile.Options == nil {
+		p.add("options", "is required")
+	} else {
+		checkOptions(p, rugFile.Options, rugFile.allSpiders())
+	}
+
+	if rugFile.Spider != nil {
+		if len(rugFile.Spiders) > 0 {
+			p.add("spiders", "can't be used with spider")
+		}
+		checkSpider(p, "spider", rugFile.Spider)
+	} else if len(rugFile.Spiders) == 0 {
+		p.add("spider", "is required, or spiders")
+	}
+	var spiderNames = map[string]bool{}
+	for i, s := range rugFile.Spiders {
+		path := fmt.Sprintf("spiders[%d]", i)
+		if s == nil {
+			p.add(path, "should be an object")
+			continue
+		}
+		if s.Name == "" {
+			p.add(path+".name", "is required")
+		} else if strings.Contains(s.Name, "|") {
+			p.add(path+".name", "can't contain |")
+		} else if spiderNames[s.Name] {
+			p.add(path+".name", "another spider is named \"%s\"", s.Name)
+		}
+		spiderNames[s.Name] = true
+		checkSpider(p, path, s)
+	}
+
+	var names = map[string]bool{}
+	var outputs = map[string]string{}
+	for i, sc := range rugFile.Scrapers {
+		path := fmt.Sprintf("scrapers[%d]", i)
+		if sc == nil {
+			p.add(path, "should be an object")
+			continue
+		}
+		if sc.Name == "" {
+			p.add(path+".name", "is required")
+		} else if strings.Contains(sc.Name, "|") {
+			p.add(path+".name", "can't contain |")
+		} else if names[sc.Name] {
+			p.add(path+".name", "another scraper is named \"%s\"", sc.Name)
+		}
+		names[sc.Name] = true
+		checkScraper(p, path, rugFile.Options, sc)
+		// Scrapers which share a file would append to and truncate it in
+		// turn. A scraper which extends another inherits its output unless
+		// it sets its own.
+		if key := outputKey(sc.Output); key != "" {
+			if other, ok := outputs[key]; ok {
+				p.add(path+".output", "scraper \"%s\" writes to the same output", other)
+			} else {
+				outputs[key] = sc.Name
+			}
+		}
+		for j, name := range sc.Spiders {
+			if !spiderNames[name] {
+				p.add(fmt.Sprintf("%s.spiders[%d]", path, j), "no spider is named \"%s\"", name)
+			}
+		}
+	}
+}
+
+func checkSpider(p *configProblems, path string, s *ConfigSpider) {
+	if len(s.URLs) == 0 {
+		p.add(path+".urls", "should have at least one URL")
+	}
+	checkXPath(p, path+".test", s.TestXPATH)
+	var ruleNames = map[string]bool{}
+	for i, rule := range s.Links {
+		rulePath := fmt.Sprintf("%s.links[%d]", path, i)
+		if rule == nil {
+			p.add(rulePath, "should be an XPath or an object")
+			continue
+		}
+		checkLinkRule(p, rulePath, rule)
+		if rule.Name != "" && ruleNames[rule.Name] {
+			p.add(rulePath+".name", "another link rule is named \"%s\"", rule.Name)
+		}
+		ruleNames[rule.Name] = true
+	}
+	if s.Options != nil {
+		if s.Options.Concurrency != nil && *s.Options.Concurrency < 1 {
+			p.add(path+".options.concurrency", "should be at least 1")
+		}
+		if s.Options.MaxResults != nil && *s.Options.MaxResults < 0 {
+			p.add(path+".options.max", "should be 0 for no limit, or more")
+		}
+		checkEnum(p, path+".options.order", s.Options.Order, true, orderBFS, orderDFS, orderPriority)
+	}
+}
+
+func checkOptions(p *configProblems, options *ConfigOptions, spiders []*ConfigSpider) {
+	// Spider options are only required if a spider doesn't set its own
+	var required = len(spiders) == 0
+	for _, s := range spiders {
+		if s != nil && (s.Options == nil || s.Options.Concurrency == nil) {
+			required = true
+		}
+	}
+
+	if options.SpiderOptions == nil {
+		if required {
+			p.add("options.spiders", "is required")
+		}
+	} else {
+		if options.SpiderOptions.Concurrency < 0 || (required && options.SpiderOptions.Concurrency < 1) {
+			p.add("options.spiders.concurrency", "should be at least 1")
+		}
+		if options.SpiderOptions.MaxResults < 0 {
+			p.add("options.spiders.max", "should be 0 for no limit, or more")
+		}
+		checkEnum(p, "options.spiders.order", options.SpiderOptions.Order, true, orderBFS, orderDFS, orderPriority)
+	}
+
+	if options.StoreOptions == nil {
+		p.add("options.store", "is required")
+	} else {
+		checkEnum(p, "options.store.strategy", options.StoreOptions.Strategy, false, strategyDisk, strategyMem)
+	}
+
+	if options.TransformOptions != nil {
+		if options.TransformOptions.Timeout < -1 {
+			p.add("options.transforms.timeout", "should be -1 for no limit, or more")
+		}
+		if options.TransformOptions.MaxMemory < 0 {
+			p.add("options.transforms.maxMemory", "should be 0 for no limit, or more")
+		}
+	}
+}
+
+// outputKey identifies the file an output writes to, and for SQLite the
+// table, or returns an empty string if it writes to stdout.
+func outputKey(output *ConfigOutput) string {
+	if output == nil || output.Path == "" || output.Path == outputStdout {
+		return ""
+	}
+	key := filepath.Clean(output.Path)
+	if output.Type == outputSQLite {
+		key += "|" + output.Table
+	}
+	return key
+}
+
+// checkOutput checks the columns and table of an output, which are written
+// into CSV headers, SQL statements and parquet schemas.
+func checkOutput(p *configProblems, path string, output *ConfigOutput) {
+	switch output.Type {
+	case outputCSV, outputSQLite, outputParquet:
+		if len(output.Columns) == 0 {
+			p.add(path+".columns", "is required for %s outputs", output.Type)
+		}
+	}
+	if output.Type == outputSQLite && output.Table == "" {
+		p.add(path+".table", "is required for sqlite outputs")
+	}
+
+	var columns = map[string]bool{}
+	for i, c := range output.Columns {
+		columnPath := fmt.Sprintf("%s.columns[%d]", path, i)
+		if c == "" {
+			p.add(columnPath, "should not be empty")
+		} else if columns[c] {
+			p.add(columnPath, "is listed twice")
+		} else if output.Type == outputParquet && !parquetColumnPattern.MatchString(c) {
+			p.add(columnPath, "should only contain letters, digits and _ for parquet outputs")
+		}
+		columns[c] = true
+	}
+	if output.Type == outputSQLite {
+		for i, k := range output.Key {
+			if !columns[k] {
+				p.add(fmt.Sprintf("%s.key[%d]", path, i), "should be one of the columns")
+			}
+		}
+	}
+}
+
+func checkScraper(p *configProblems, path string, options *ConfigOptions, sc *ConfigScraper) {
+	if sc.Output == nil || sc.Output.Path == "" {
+		p.add(path+".output", "should have a path")
+	} else {
+		checkEnum(p, path+".output.type", sc.Output.Type, true, outputJSONL, outputCSV, outputSQLite, outputParquet)
+		checkOutput(p, path+".output", sc.Output)
+	}
+	checkEnum(p, path+".dedupe", sc.Dedupe, true, dedupeFirst, dedupeLast, dedupeMerge)
+	checkEnum(p, path+".onTransformError", sc.OnTransformError, true, transformErrorAbort, transformErrorSkip)
+	if sc.Dedupe != "" && len(sc.Key) == 0 {
+		p.add(path+".dedupe", "requires a key")
+	} else if (sc.Dedupe == dedupeLast || sc.Dedupe == dedupeMerge) && !upsertsKey(sc.Output, sc.Key) {
+		p.add(path+".dedupe", "requires a sqlite output with the same key")
+	}
+
+	checkXPath(p, path+".test", sc.Test)
+	checkXPath(p, path+".context", sc.Context)
+	if len(sc.Fields) == 0 {
+		p.add(path+".fields", "should have at least one field")
+	}
+	limits := getTransformLimits(options)
+	checkFields(p, path+".fields", sc.Fields, limits)
+
+	for i, config := range sc.Transforms {
+		transformPath := fmt.Sprintf("%s.transforms[%d]", path, i)
+		if config == nil {
+			p.add(transformPath, "should be a path or an object")
+			continue
+		}
+		t, _, err := loadTransform(fmt.Sprintf("%s.transforms[%d]", sc.Name, i), config, limits)
+		if err != nil {
+			p.add(transformPath, "%s", err)
+			continue
+		}
+		t.Close()
+	}
+}
+
+// fieldKeys are the keys of a field given as an object.
+var fieldKeys = []string{"xpath", "context", "fields", "transform"}
+
+func checkFields(p *configProblems, path string, fields map[string]interface{}, limits TransformLimits) {
+	for _, k := range sortedKeys(fields) {
+		fieldPath := joinPath(path, k)
+		switch f := fields[k].(type) {
+		case string:
+			checkXPath(p, fieldPath, f)
+		case map[string]interface{}:
+			for _, key := range sortedKeys(f) {
+				if !containsString(fieldKeys, key) {
+					p.add(joinPath(fieldPath, key), "unknown key")
+				}
+			}
+			_, hasXPath := f["xpath"]
+			_, hasFields := f["fields"]
+			if hasXPath == hasFields {
+				p.add(fieldPath, "should have either an xpath or fields")
+			}
+			if _, ok := f["context"]; ok && !hasFields {
+				p.add(joinPath(fieldPath, "context"), "can only be used with fields")
+			}
+			for _, key := range []string{"xpath", "context"} {
+				if v, ok := f[key]; ok {
+					s, ok := v.(string)
+					if !ok {
+						p.add(joinPath(fieldPath, key), "should be a string")
+						continue
+					}
+					checkXPath(p, joinPath(fieldPath, key), s)
+				}
+			}
+			if v, ok := f["fields"]; ok {
+				nested, ok := v.(map[string]interface{})
+				if !ok {
+					p.add(joinPath(fieldPath, "fields"), "should be an object")
+				} else {
+					checkFields(p, joinPath(fieldPath, "fields"), nested, limits)
+				}
+			}
+			if v, ok := f["transform"]; ok {
+				transformPath, ok := v.(string)
+				if !ok {
+					p.add(joinPath(fieldPath, "transform"), "should be a string")
+					continue
+				}
+				t, _, err := loadScript(transformPath, limits)
+				if err != nil {
+					p.add(joinPath(fieldPath, "transform"), "%s", err)
+					continue
+				}
+				t.Close()
+			}
+		default:
+			p.add(fieldPath, "should be an XPath or an object")
+		}
+	}
+}
+
+// checkLinkRule checks a link rule. Its XPath is reported at the rule itself,
+// as the rule may be given as just the XPath.
+func checkLinkRule(p *configProblems, path string, rule *ConfigLinkRule) {
+	if rule.XPath == "" {
+		p.add(path+".xpath", "is required")
+	}
+	checkXPath(p, path, rule.XPath)
+	if !rule.follows() && rule.Name == "" {
+		p.add(path+".name", "is required to not follow links")
+	}
+	if rule.MaxDepth < 0 {
+		p.add(path+".maxDepth", "should be 0 for no limit, or more")
+	}
+	checkPatterns(p, path+".include", rule.Include)
+	checkPatterns(p, path+".exclude", rule.Exclude)
+}
+
+func checkPatterns(p *configProblems, path string, patterns []string) {
+	for i, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			p.add(fmt.Sprintf("%s[%d]", path, i), "invalid pattern %s", strconv.Quote(pattern))
+		}
+	}
+}
+
+func checkXPath(p *configProblems, path string, expr string) {
+	if expr == "" {
+		return
+	}
+	e, err := xpath.NewExpression(expr)
+	if err != nil {
+		p.add(path, "invalid XPath %s", strconv.Quote(expr))
+		return
+	}
+	e.Free()
+}
+
+// checkEnum checks that value is one of values. Empty values are allowed if
+// the value is optional.
+func checkEnum(p *configProblems, path string, value string, optional bool, values ...string) {
+	if value == "" && optional {
+		return
+	}
+	if containsString(values, value) {
+		return
+	}
+	if value == "" {
+		p.add(path, "is required, and should be one of %s", strings.Join(values, ", "))
+		return
+	}
+	p.add(path, "unknown value \"%s\", should be one of %s", value, strings.Join(values, ", "))
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
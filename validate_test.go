@@ -0,0 +1,290 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRugFile(t *testing.T) {
+	err := ioutil.WriteFile("test_valid.lua", []byte(`function transform(state) return state end`), 0600)
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove("test_valid.lua")
+
+	rugFile, problems, err := validateRugFile([]byte(`{
+		"name": "Test",
+		"options": {
+			"store": {"strategy": "memory"},
+			"spiders": {"concurrency": 3, "max": 5}
+		},
+		"spider": {
+			"urls": ["http://foo.com"],
+			"links": ["//a/@href"]
+		},
+		"scrapers": [{
+			"name": "Links",
+			"output": "links.jsonl",
+			"context": "//a",
+			"fields": {
+				"title": "./text()",
+				"upper": {"xpath": "./text()", "transform": "test_valid.lua"},
+				"items": {"context": "./span", "fields": {"text": "./text()"}}
+			},
+			"transforms": ["test_valid.lua", {"set": {"slug": "lower(title)"}}]
+		}]
+	}`))
+	assert.NoError(t, err)
+	assert.Len(t, problems, 0)
+	assert.Equal(t, "Links", rugFile.Scrapers[0].Name)
+}
+
+func TestValidateUnknownKeys(t *testing.T) {
+	_, problems, err := validateRugFile([]byte(`{
+		"name": "Test",
+		"options": {
+			"store": {"strategy": "memory"},
+			"spiders": {"concurency": 3}
+		},
+		"spider": {"urls": "http://foo.com"},
+		"scraper": [],
+		"scrapers": [{"name": "Links", "output": {"path": "links.jsonl", "colums": ["a"]}}]
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []ConfigProblem{
+		{"options.spiders.concurency", "unknown key, did you mean \"concurrency\"?"},
+		{"scraper", "unknown key, did you mean \"scrapers\"?"},
+		{"scrapers[0].output.colums", "unknown key, did you mean \"columns\"?"},
+		{"spider.urls", "should be an array"},
+	}, problems)
+}
+
+func TestValidateProblems(t *testing.T) {
+	err := ioutil.WriteFile("test_invalid.js", []byte(`function transform(state) {`), 0600)
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove("test_invalid.js")
+
+	_, problems, err := validateRugFile([]byte(`{
+		"name": "Test",
+		"options": {
+			"store": {"strategy": "cloud"}
+		},
+		"spider": {
+			"urls": [],
+			"links": ["//a[@href"]
+		},
+		"scrapers": [{
+			"name": "Links",
+			"output": {"type": "xml", "path": "links.xml"},
+			"test": "//div[",
+			"fields": {
+				"title": {"xpath": "./text(", "transform": "missing.lua", "foo": 1},
+				"count": 1
+			},
+			"transforms": ["test_invalid.js", {"where": "price >"}],
+			"dedupe": "last"
+		}, {
+			"name": "Links",
+			"output": "links.jsonl",
+			"fields": {}
+		}, {
+			"name": "Links|Titles",
+			"output": "titles.jsonl",
+			"fields": {"title": "//h1"}
+		}]
+	}`))
+	assert.NoError(t, err)
+
+	var paths = map[string]bool{}
+	for _, p := range problems {
+		paths[p.Path] = true
+	}
+	for _, path := range []string{
+		"options.spiders",
+		"options.store.strategy",
+		"spider.urls",
+		"spider.links[0]",
+		"scrapers[0].output.type",
+		"scrapers[0].dedupe",
+		"scrapers[0].test",
+		"scrapers[0].fields.title.xpath",
+		"scrapers[0].fields.title.transform",
+		"scrapers[0].fields.title.foo",
+		"scrapers[0].fields.count",
+		"scrapers[0].transforms[0]",
+		"scrapers[0].transforms[1]",
+		"scrapers[1].name",
+		"scrapers[1].fields",
+		"scrapers[2].name",
+	} {
+		assert.True(t, paths[path], path)
+	}
+	assert.Len(t, problems, 16)
+}
+
+func TestLoadRugFile(t *testing.T) {
+	err := ioutil.WriteFile("test_rug.json", []byte(`{"name": "Test"}`), 0600)
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove("test_rug.json")
+
+	_, err = loadRugFile("test_rug.json")
+	assert.Error(t, err)
+	verr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "Invalid config in test_rug.json:\n  options: is required\n  spider: is required, or spiders", verr.Error())
+
+	_, err = loadRugFile("test_missing.json")
+	assert.Error(t, err)
+}
+
+func TestValidateSpiders(t *testing.T) {
+	_, problems, err := validateRugFile([]byte(`{
+		"name": "Test",
+		"options": {
+			"store": {"strategy": "memory"}
+		},
+		"spiders": [
+			{"name": "catalog", "urls": ["http://foo.com"], "options": {"concurrency": 2}},
+			{"name": "catalog", "urls": ["http://foo.com/blog"], "options": {"concurrency": 0}},
+			{"urls": [], "options": {"concurrency": 1, "max": -1}}
+		],
+		"scrapers": [{
+			"name": "Links",
+			"output": "links.jsonl",
+			"fields": {"title": "//title"},
+			"spiders": ["catalog", "blog"]
+		}]
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []ConfigProblem{
+		{"spiders[1].name", "another spider is named \"catalog\""},
+		{"spiders[1].options.concurrency", "should be at least 1"},
+		{"spiders[2].name", "is required"},
+		{"spiders[2].urls", "should have at least one URL"},
+		{"spiders[2].options.max", "should be 0 for no limit, or more"},
+		{"scrapers[0].spiders[1]", "no spider is named \"blog\""},
+	}, problems)
+}
+
+func TestValidateSpiderOptions(t *testing.T) {
+	var spiders = `[
+		{"name": "catalog", "urls": ["http://foo.com"], "options": {"concurrency": 2}},
+		{"name": "blog", "urls": ["http://foo.com/blog"], "options": {"concurrency": 1}}
+	]`
+
+	// Every spider sets its own concurrency, so options.spiders isn't needed
+	_, problems, err := validateRugFile([]byte(`{
+		"name": "Test",
+		"options": {"store": {"strategy": "memory"}},
+		"spiders": ` + spiders + `
+	}`))
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	_, problems, err = validateRugFile([]byte(`{
+		"name": "Test",
+		"options": {"store": {"strategy": "memory"}, "spiders": {"max": 10}},
+		"spiders": ` + spiders + `
+	}`))
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// One doesn't, so options.spiders needs a concurrency for it
+	_, problems, err = validateRugFile([]byte(`{
+		"name": "Test",
+		"options": {"store": {"strategy": "memory"}, "spiders": {"max": 10}},
+		"spiders": [{"name": "catalog", "urls": ["http://foo.com"]}]
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []ConfigProblem{
+		{"options.spiders.concurrency", "should be at least 1"},
+	}, problems)
+}
+
+func TestValidateSharedOutputs(t *testing.T) {
+	_, problems, err := validateRugFile([]byte(`{
+		"name": "Test",
+		"options": {
+			"store": {"strategy": "memory"},
+			"spiders": {"concurrency": 1}
+		},
+		"spider": {"urls": ["http://foo.com"]},
+		"scrapers": [
+			{"name": "Articles", "output": "articles.jsonl", "fields": {"title": "//title"}},
+			{"name": "Drafts", "output": "./articles.jsonl", "fields": {"title": "//title"}},
+			{"name": "Stdout", "output": "-", "fields": {"title": "//title"}},
+			{"name": "Piped", "output": "-", "fields": {"title": "//title"}},
+			{"name": "Links", "output": {"type": "sqlite", "path": "db.sqlite", "table": "links", "columns": ["url"]}, "fields": {"url": "//a/@href"}},
+			{"name": "Images", "output": {"type": "sqlite", "path": "db.sqlite", "table": "images", "columns": ["url"]}, "fields": {"url": "//img/@src"}}
+		]
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []ConfigProblem{
+		{"scrapers[1].output", "scraper \"Articles\" writes to the same output"},
+	}, problems)
+}
+
+func TestValidateOutputs(t *testing.T) {
+	_, problems, err := validateRugFile([]byte(`{
+		"name": "Test",
+		"options": {
+			"store": {"strategy": "memory"},
+			"spiders": {"concurrency": 1}
+		},
+		"spider": {"urls": ["http://foo.com"]},
+		"scrapers": [
+			{"name": "CSV", "output": {"type": "csv", "path": "links.csv"}, "fields": {"title": "//title"}},
+			{"name": "SQLite", "output": {"type": "sqlite", "path": "links.sqlite", "columns": ["order", "url", "url"], "key": ["id"]}, "fields": {"title": "//title"}},
+			{"name": "Parquet", "output": {"type": "parquet", "path": "links", "columns": ["title", "page url", "a=b", ""]}, "fields": {"title": "//title"}}
+		]
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []ConfigProblem{
+		{"scrapers[0].output.columns", "is required for csv outputs"},
+		{"scrapers[1].output.table", "is required for sqlite outputs"},
+		{"scrapers[1].output.columns[2]", "is listed twice"},
+		{"scrapers[1].output.key[0]", "should be one of the columns"},
+		{"scrapers[2].output.columns[1]", "should only contain letters, digits and _ for parquet outputs"},
+		{"scrapers[2].output.columns[2]", "should only contain letters, digits and _ for parquet outputs"},
+		{"scrapers[2].output.columns[3]", "should not be empty"},
+	}, problems)
+}
+
+func TestValidateLinkRules(t *testing.T) {
+	rugFile, problems, err := validateRugFile([]byte(`{
+		"name": "Test",
+		"options": {
+			"store": {"strategy": "memory"},
+			"spiders": {"concurrency": 1}
+		},
+		"spider": {
+			"urls": ["http://foo.com"],
+			"links": [
+				"//a/@href",
+				{"name": "pages", "xpath": "//a[@rel='next']/@href", "maxDepth": 2, "priority": 1},
+				{"name": "pages", "xpath": "//a[", "follow": false, "maxDepth": -1},
+				{"follow": false, "include": ["(item"], "exclude": ["print"]}
+			]
+		}
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []ConfigProblem{
+		{"spider.links[2]", "invalid XPath \"//a[\""},
+		{"spider.links[2].maxDepth", "should be 0 for no limit, or more"},
+		{"spider.links[2].name", "another link rule is named \"pages\""},
+		{"spider.links[3].xpath", "is required"},
+		{"spider.links[3].name", "is required to not follow links"},
+		{"spider.links[3].include[0]", "invalid pattern \"(item\""},
+	}, problems)
+	assert.Equal(t, "//a/@href", rugFile.Spider.Links[0].XPath)
+	assert.True(t, rugFile.Spider.Links[0].follows())
+	assert.Equal(t, 2, rugFile.Spider.Links[1].MaxDepth)
+	assert.False(t, rugFile.Spider.Links[2].follows())
+}